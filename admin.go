@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	rj "github.com/bottlenose-inc/rapidjson" // faster json handling
+	"github.com/gorilla/mux"                 // URL router and dispatcher
+)
+
+const (
+	ADMIN_LOOKUP     = "lookup"
+	ADMIN_PURGE_URL  = "purge_url"
+	ADMIN_PURGE_HOST = "purge_host"
+	ADMIN_REFRESH    = "refresh"
+)
+
+// AdminConfig configures the cache administration routes under /admin. They
+// are disabled unless Token is set, here or in the ADMIN_TOKEN environment
+// variable, and requests must send it as "Authorization: Bearer <token>".
+type AdminConfig struct {
+	Token string `yaml:"token"`
+}
+
+// Init reads the token from the environment if it is set there.
+func (c *AdminConfig) Init() {
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		c.Token = token
+	}
+}
+
+// addAdminRoutes registers the cache administration routes on router.
+func addAdminRoutes(router *mux.Router) {
+	router.Methods("GET").Path("/admin/cache").Handler(AdminHandler(ADMIN_LOOKUP, AdminLookup))
+	router.Methods("DELETE").Path("/admin/cache").Handler(AdminHandler(ADMIN_PURGE_URL, AdminPurgeURL))
+	router.Methods("DELETE").Path("/admin/cache/hosts/{host}").Handler(AdminHandler(ADMIN_PURGE_HOST, AdminPurgeHost))
+	router.Methods("POST").Path("/admin/refresh").Handler(AdminHandler(ADMIN_REFRESH, AdminRefresh))
+}
+
+// adminStatusWriter records the status code of an admin response.
+type adminStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *adminStatusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// AdminHandler checks the admin token before calling handler, and counts the
+// request in adminRequestsCounterVector by action and status code.
+func AdminHandler(action string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &adminStatusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			adminRequestsCounterVector.WithLabelValues(action, strconv.Itoa(sw.status)).Inc()
+		}()
+
+		if cfg.Admin.Token == "" {
+			NotFound(sw, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Admin.Token)) != 1 {
+			logger.Warning("Unauthorized admin request", map[string]string{"action": action, "remote": r.RemoteAddr})
+			SendErrorResponse(sw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(sw, r)
+	})
+}
+
+// adminURL returns the URL in the url query parameter, normalized like
+// requested links, or sends an error response.
+func adminURL(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	reqStr := r.URL.Query().Get("url")
+	if reqStr == "" {
+		SendErrorResponse(w, "Missing url parameter", http.StatusBadRequest)
+		return "", "", false
+	}
+	chain := &RedirectChain{}
+	reqStr = chain.Unwrap(reqStr)
+	_, rootUrl, hash, err := NormalizeURL(reqStr)
+	if err != nil {
+		SendErrorResponse(w, "Invalid url parameter", http.StatusBadRequest)
+		return "", "", false
+	}
+	return rootUrl, hash, true
+}
+
+// addLocalCacheTTL adds to a purge response how long instances with a tiered
+// cache may keep serving purged results from their LRU, which is only
+// purged on the instance handling the request.
+func addLocalCacheTTL(response *rj.Container) {
+	if cfg.Cache.Backend == CACHE_TIERED {
+		response.AddValue("localCacheTTLsec", cfg.Cache.LRUTTLSec)
+	}
+}
+
+// sendAdminResponse writes an admin response document.
+func sendAdminResponse(w http.ResponseWriter, doc *rj.Doc, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write(doc.Bytes()); err != nil {
+		logger.Error("Error writing admin response: " + err.Error())
+	}
+}
+
+// AdminLookup sends the cached result for a URL with its cache key and
+// remaining TTL.
+func AdminLookup(w http.ResponseWriter, r *http.Request) {
+	rootUrl, hash, ok := adminURL(w, r)
+	if !ok {
+		return
+	}
+	responseJson := rj.NewDoc()
+	defer responseJson.Free()
+	response := responseJson.GetContainerNewObj()
+	response.AddValue("url", rootUrl)
+	response.AddValue("key", ResultKey(hash))
+
+	cached, err := GetResult(hash)
+	if err == CacheUnavailable {
+		SendErrorResponse(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		response.AddValue("cached", false)
+		sendAdminResponse(w, responseJson, http.StatusNotFound)
+		return
+	}
+	cachedJson, err := rj.NewParsedStringJson(cached)
+	if err != nil {
+		SendErrorResponse(w, "Unreadable cache entry", http.StatusInternalServerError)
+		return
+	}
+	defer cachedJson.Free()
+	response.AddValue("cached", true)
+	if ttl, err := cache.TTL(ResultKey(hash)); err == nil {
+		response.AddValue("ttlSec", int(ttl.Seconds()))
+	}
+	item := responseJson.NewContainerObj()
+	item.SetContainer(cachedJson.GetContainer())
+	response.AddMember("result", item)
+	sendAdminResponse(w, responseJson, http.StatusOK)
+}
+
+// AdminPurgeURL drops the cached result for a URL.
+func AdminPurgeURL(w http.ResponseWriter, r *http.Request) {
+	rootUrl, hash, ok := adminURL(w, r)
+	if !ok {
+		return
+	}
+	purged := 0
+	if _, err := cache.TTL(ResultKey(hash)); err == nil {
+		purged = 1
+	}
+	if err := DeleteResult(hash); err != nil {
+		SendErrorResponse(w, "Error purging cache: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	logger.Info("Purged cached result for " + rootUrl)
+
+	responseJson := rj.NewDoc()
+	defer responseJson.Free()
+	response := responseJson.GetContainerNewObj()
+	response.AddValue("url", rootUrl)
+	response.AddValue("purged", purged)
+	addLocalCacheTTL(response)
+	sendAdminResponse(w, responseJson, http.StatusOK)
+}
+
+// AdminPurgeHost drops all cached results for a host.
+func AdminPurgeHost(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(mux.Vars(r)["host"])
+	purged, err := cache.DeletePrefix(HostResultsPrefix(host))
+	if err != nil {
+		SendErrorResponse(w, "Error purging cache: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	logger.Info("Purged " + strconv.Itoa(purged) + " cached results for host " + host)
+
+	responseJson := rj.NewDoc()
+	defer responseJson.Free()
+	response := responseJson.GetContainerNewObj()
+	response.AddValue("host", host)
+	response.AddValue("purged", purged)
+	addLocalCacheTTL(response)
+	sendAdminResponse(w, responseJson, http.StatusOK)
+}
+
+// AdminRefresh fetches a URL again without reading the cache, and sends the
+// new result, which replaces the cached one.
+func AdminRefresh(w http.ResponseWriter, r *http.Request) {
+	rootUrl, _, ok := adminURL(w, r)
+	if !ok {
+		return
+	}
+	result := ProcessLink(r.Context(), r.URL.Query().Get("url"), CacheOptions{NoCache: true})
+	defer result.Free()
+
+	responseJson := rj.NewDoc()
+	defer responseJson.Free()
+	response := responseJson.GetContainerNewObj()
+	response.AddValue("url", rootUrl)
+	item := responseJson.NewContainerObj()
+	item.SetContainer(result.docs[0].GetContainer())
+	response.AddMember("result", item)
+	sendAdminResponse(w, responseJson, http.StatusOK)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andybalholm/brotli"      // brotli decoder
+	"github.com/klauspost/compress/zstd" // zstd decoder
+)
+
+const (
+	ACCEPT_ENCODING = "br, gzip, deflate, zstd"
+
+	ZSTD_MAX_WINDOW_BYTES = 8 * 1024 * 1024 // window limit recommended for HTTP by RFC 8878
+)
+
+// CappedReader reads at most a fixed number of bytes from the underlying
+// reader and then reports EOF, remembering whether there was more to read.
+type CappedReader struct {
+	r         io.Reader
+	remaining int64
+	truncated bool
+}
+
+// NewCappedReader returns a CappedReader reading at most limit bytes from r.
+func NewCappedReader(r io.Reader, limit int64) *CappedReader {
+	return &CappedReader{r: r, remaining: limit}
+}
+
+func (c *CappedReader) Read(p []byte) (int, error) {
+	if c.remaining <= 0 {
+		// probe one byte to tell a truncated body from one that fit exactly
+		if !c.truncated {
+			var probe [1]byte
+			if n, _ := c.r.Read(probe[:]); n > 0 {
+				c.truncated = true
+			}
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// Truncated reports whether the limit was reached with data left unread.
+func (c *CappedReader) Truncated() bool {
+	return c.truncated
+}
+
+// decodingReader reads through a chain of decoders and closes all of them.
+type decodingReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decodingReader) Close() error {
+	var err error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if closeErr := d.closers[i].Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// NewDecodingReader returns a reader decoding r according to the value of a
+// Content-Encoding header. Encodings are listed in the order they were
+// applied, so they are undone from last to first.
+func NewDecodingReader(r io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	decoder := &decodingReader{Reader: r}
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		switch encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			gzipReader, err := gzip.NewReader(decoder.Reader)
+			if err != nil {
+				decoder.Close()
+				return nil, &FetchError{Code: ERROR_PARSE, Msg: "gzip error: " + err.Error()}
+			}
+			decoder.Reader = gzipReader
+			decoder.closers = append(decoder.closers, gzipReader)
+		case "deflate":
+			deflateReader, err := newDeflateReader(decoder.Reader)
+			if err != nil {
+				decoder.Close()
+				return nil, &FetchError{Code: ERROR_PARSE, Msg: "deflate error: " + err.Error()}
+			}
+			decoder.Reader = deflateReader
+			decoder.closers = append(decoder.closers, deflateReader)
+		case "br":
+			decoder.Reader = brotli.NewReader(decoder.Reader)
+		case "zstd":
+			zstdReader, err := zstd.NewReader(decoder.Reader,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxWindow(ZSTD_MAX_WINDOW_BYTES))
+			if err != nil {
+				decoder.Close()
+				return nil, &FetchError{Code: ERROR_PARSE, Msg: "zstd error: " + err.Error()}
+			}
+			decoder.Reader = zstdReader
+			decoder.closers = append(decoder.closers, zstdReader.IOReadCloser())
+		default:
+			decoder.Close()
+			return nil, &FetchError{Code: ERROR_UNSUPPORTED_ENCODING, Msg: "Unsupported content-encoding: " + encoding}
+		}
+	}
+	if len(decoder.closers) == 0 {
+		return ioutil.NopCloser(decoder.Reader), nil
+	}
+	return decoder, nil
+}
+
+// newDeflateReader handles both zlib wrapped deflate, as the spec requires,
+// and the raw deflate streams some servers send instead.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half_open"
+)
+
+var (
+	CircuitOpen = errors.New("Circuit open for host")
+
+	breakersLock sync.Mutex
+	breakers     = make(map[string]*hostBreaker) // only hosts with recent failures
+)
+
+// BreakerConfig configures the per-host circuit breaker. A host's circuit
+// opens after FailureThreshold consecutive timeouts, connection failures or
+// 5xx responses; fetches then fail fast for OpenSec seconds, after which a
+// single probe fetch decides whether to close it again.
+type BreakerConfig struct {
+	Enabled          bool `yaml:"enabled"`
+	FailureThreshold int  `yaml:"failureThreshold"`
+	OpenSec          int  `yaml:"openSec"`
+
+	OpenDuration time.Duration
+}
+
+type hostBreaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+// BreakerAllow returns CircuitOpen if fetches to host should fail fast. When
+// it returns nil the outcome must be reported with BreakerRecord.
+func BreakerAllow(host string) error {
+	if !cfg.Breaker.Enabled {
+		return nil
+	}
+	host = strings.ToLower(host)
+
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		return nil
+	}
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < cfg.Breaker.OpenDuration {
+			return CircuitOpen
+		}
+		// let this fetch through as the probe
+		b.setState(BREAKER_HALF_OPEN)
+		return nil
+	case BREAKER_HALF_OPEN:
+		// a probe is already in flight
+		return CircuitOpen
+	}
+	return nil
+}
+
+// BreakerRecord reports the outcome of a fetch allowed by BreakerAllow.
+func BreakerRecord(host string, result *http.Response, err error) {
+	if !cfg.Breaker.Enabled {
+		return
+	}
+	host = strings.ToLower(host)
+	failed := IsHostFailure(result, err)
+
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	b, ok := breakers[host]
+	if !failed {
+		if ok {
+			breakerStateGauge.WithLabelValues(b.state).Dec()
+			delete(breakers, host)
+		}
+		return
+	}
+
+	if !ok {
+		b = &hostBreaker{state: BREAKER_CLOSED}
+		breakers[host] = b
+		breakerStateGauge.WithLabelValues(BREAKER_CLOSED).Inc()
+	}
+	b.failures++
+	if b.state == BREAKER_HALF_OPEN || (b.state == BREAKER_CLOSED && b.failures >= cfg.Breaker.FailureThreshold) {
+		b.openedAt = time.Now()
+		b.setState(BREAKER_OPEN)
+		breakerTripsCounter.Inc()
+	}
+}
+
+// BreakerAbort reports that a fetch allowed by BreakerAllow was abandoned
+// before its outcome was known. A half-open circuit goes back to open, and
+// the next fetch is let through as the probe instead.
+func BreakerAbort(host string) {
+	if !cfg.Breaker.Enabled {
+		return
+	}
+	host = strings.ToLower(host)
+
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	if b, ok := breakers[host]; ok && b.state == BREAKER_HALF_OPEN {
+		b.setState(BREAKER_OPEN)
+	}
+}
+
+// IsHostFailure reports whether a fetch outcome indicates the host is down:
+// a timeout, a failed connection or a 5xx response.
+func IsHostFailure(result *http.Response, err error) bool {
+	if err != nil {
+		if urlError, ok := err.(*url.Error); ok && urlError.Err == RedirectAttempted {
+			return false
+		}
+		if errors.Is(err, AddressBlocked) {
+			return false
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+		var opErr *net.OpError
+		return errors.As(err, &opErr)
+	}
+	return result != nil && result.StatusCode >= 500
+}
+
+// setState moves the breaker to state, keeping the state gauges in step.
+// Callers hold breakersLock.
+func (b *hostBreaker) setState(state string) {
+	breakerStateGauge.WithLabelValues(b.state).Dec()
+	b.state = state
+	breakerStateGauge.WithLabelValues(state).Inc()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CACHE_REDIS  = "redis"  // all instances share one redis
+	CACHE_LRU    = "lru"    // in-process only, for tests and single-node setups
+	CACHE_TIERED = "tiered" // in-process LRU in front of redis
+)
+
+var (
+	CacheMiss = errors.New("Cache miss")
+
+	cache Cache // link results, robots.txt files and locks
+)
+
+// Cache stores string values under keys for a TTL. Get and TTL return
+// CacheMiss for keys that are not set or have expired. SetNX only sets keys
+// that are not set, which makes it usable as a lock. A ttl of zero or less
+// stores nothing: Set deletes the key, and SetNX sets nothing and reports
+// false. DeletePrefix deletes all keys starting with prefix and returns how
+// many there were. Ready reports whether the cache can be used; while it
+// cannot, calls fail with CacheUnavailable.
+type Cache interface {
+	Get(key string) (string, error)
+	Set(key string, value string, ttl time.Duration) error
+	SetNX(key string, value string, ttl time.Duration) (bool, error)
+	Delete(key string) error
+	TTL(key string) (time.Duration, error)
+	DeletePrefix(prefix string) (int, error)
+	Ready() error
+}
+
+// CacheConfig selects the cache backend. The LRU holds at most
+// LRUMaxEntries entries and LRUMaxMB of keys and values; in front of redis it
+// keeps entries for at most LRUTTLSec, so that changes made by other
+// instances show up within that time. KeyPrefix is prepended to every key,
+// and results of at least CompressMinBytes are stored with Compression.
+type CacheConfig struct {
+	Backend          string `yaml:"backend"`
+	LRUMaxEntries    int    `yaml:"lruMaxEntries"`
+	LRUMaxMB         int    `yaml:"lruMaxMB"`
+	LRUTTLSec        int    `yaml:"lruTTLsec"`
+	KeyPrefix        string `yaml:"keyPrefix"`
+	Compression      string `yaml:"compression"`
+	CompressMinBytes int    `yaml:"compressMinBytes"`
+
+	LRUTTL time.Duration
+}
+
+// Init validates the config and derives its durations.
+func (c *CacheConfig) Init() error {
+	if c.Backend == "" {
+		c.Backend = CACHE_REDIS
+	}
+	if c.Backend != CACHE_REDIS && c.Backend != CACHE_LRU && c.Backend != CACHE_TIERED {
+		return errors.New("invalid cache backend: " + c.Backend)
+	}
+	if c.Compression == "" {
+		c.Compression = COMPRESS_NONE
+	}
+	if c.Compression != COMPRESS_NONE && c.Compression != COMPRESS_SNAPPY && c.Compression != COMPRESS_ZSTD {
+		return errors.New("invalid cache compression: " + c.Compression)
+	}
+	c.LRUTTL = time.Duration(c.LRUTTLSec) * time.Second
+	return nil
+}
+
+// NewCache creates the configured cache backend, with keys prefixed by
+// cfg.Cache.KeyPrefix.
+func NewCache() Cache {
+	lru := func() *LRUCache {
+		return NewLRUCache(cfg.Cache.LRUMaxEntries, int64(cfg.Cache.LRUMaxMB)*1024*1024)
+	}
+	var backend Cache
+	switch cfg.Cache.Backend {
+	case CACHE_LRU:
+		backend = lru()
+	case CACHE_TIERED:
+		backend = NewTieredCache(lru(), NewRedisCache(NewRedisClient(), cfg.Redis.OutageCheck), cfg.Cache.LRUTTL)
+	default:
+		backend = NewRedisCache(NewRedisClient(), cfg.Redis.OutageCheck)
+	}
+	if cfg.Cache.KeyPrefix != "" {
+		backend = prefixCache{prefix: cfg.Cache.KeyPrefix, Cache: backend}
+	}
+	return backend
+}
+
+// logCacheError logs a failed cache call, unless the cache is unavailable,
+// which is only logged when it goes down.
+func logCacheError(message string, err error) {
+	if err != CacheUnavailable {
+		logger.Error(message + ": " + err.Error())
+	}
+}
+
+// LRUCache is an in-process Cache that evicts the least recently used
+// entries beyond maxEntries entries or maxBytes of keys and values. A zero
+// limit is no limit.
+type LRUCache struct {
+	lock       sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List // most recently used first
+	size       int64
+	maxEntries int
+	maxBytes   int64
+}
+
+// lruEntry is an entry of an LRUCache.
+type lruEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// NewLRUCache returns an empty LRUCache with the given limits.
+func NewLRUCache(maxEntries int, maxBytes int64) *LRUCache {
+	return &LRUCache{
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+// get returns the live entry for key and marks it as used. The lock must be
+// held.
+func (c *LRUCache) get(key string) *lruEntry {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*lruEntry)
+	if !time.Now().Before(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry
+}
+
+// remove drops element from the cache. The lock must be held.
+func (c *LRUCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.key) + len(entry.value))
+}
+
+// set stores the entry and evicts entries beyond the limits. The lock must
+// be held.
+func (c *LRUCache) set(key string, value string, ttl time.Duration) {
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	if ttl <= 0 {
+		return
+	}
+	entry := &lruEntry{key: key, value: value, expires: time.Now().Add(ttl)}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += int64(len(key) + len(value))
+	for c.order.Len() > 0 && ((c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.size > c.maxBytes)) {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRUCache) Get(key string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if entry := c.get(key); entry != nil {
+		return entry.value, nil
+	}
+	return "", CacheMiss
+}
+
+func (c *LRUCache) Set(key string, value string, ttl time.Duration) error {
+	c.lock.Lock()
+	c.set(key, value, ttl)
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *LRUCache) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ttl <= 0 || c.get(key) != nil {
+		return false, nil
+	}
+	c.set(key, value, ttl)
+	return true, nil
+}
+
+func (c *LRUCache) Delete(key string) error {
+	c.lock.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *LRUCache) TTL(key string) (time.Duration, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if entry := c.get(key); entry != nil {
+		return time.Until(entry.expires), nil
+	}
+	return 0, CacheMiss
+}
+
+func (c *LRUCache) DeletePrefix(prefix string) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	deleted := 0
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(element)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (c *LRUCache) Ready() error {
+	return nil
+}
+
+// Len returns the number of entries, including expired ones not yet dropped.
+func (c *LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// TieredCache keeps recently used entries of a shared cache in an in-process
+// LRU for at most localTTL. Locks and TTLs always go to the shared cache.
+type TieredCache struct {
+	local    *LRUCache
+	remote   Cache
+	localTTL time.Duration
+}
+
+// NewTieredCache returns a Cache with local in front of remote.
+func NewTieredCache(local *LRUCache, remote Cache, localTTL time.Duration) *TieredCache {
+	return &TieredCache{local: local, remote: remote, localTTL: localTTL}
+}
+
+func (c *TieredCache) Get(key string) (string, error) {
+	if value, err := c.local.Get(key); err == nil {
+		return value, nil
+	}
+	value, err := c.remote.Get(key)
+	if err == nil {
+		c.local.Set(key, value, c.localTTL)
+	}
+	return value, err
+}
+
+func (c *TieredCache) Set(key string, value string, ttl time.Duration) error {
+	if ttl < c.localTTL {
+		c.local.Set(key, value, ttl)
+	} else {
+		c.local.Set(key, value, c.localTTL)
+	}
+	return c.remote.Set(key, value, ttl)
+}
+
+func (c *TieredCache) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	return c.remote.SetNX(key, value, ttl)
+}
+
+func (c *TieredCache) Delete(key string) error {
+	c.local.Delete(key)
+	return c.remote.Delete(key)
+}
+
+func (c *TieredCache) TTL(key string) (time.Duration, error) {
+	return c.remote.TTL(key)
+}
+
+// DeletePrefix deletes matching keys from both tiers, and returns how many
+// the shared cache had.
+func (c *TieredCache) DeletePrefix(prefix string) (int, error) {
+	c.local.DeletePrefix(prefix)
+	return c.remote.DeletePrefix(prefix)
+}
+
+func (c *TieredCache) Ready() error {
+	return c.remote.Ready()
+}
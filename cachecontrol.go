@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	rj "github.com/bottlenose-inc/rapidjson" // faster json handling
+)
+
+// CacheControlConfig configures deriving result TTLs from the origin's
+// Cache-Control and Expires headers, bounded by MinTTLMins and MaxTTLHours.
+// Results stay in redis for RedisTTLDays either way; once past their TTL
+// they are revalidated with a conditional GET before being served again.
+type CacheControlConfig struct {
+	Enabled     bool `yaml:"enabled"`
+	MinTTLMins  int  `yaml:"minTTLmins"`
+	MaxTTLHours int  `yaml:"maxTTLhours"`
+
+	MinTTL time.Duration
+	MaxTTL time.Duration
+}
+
+// Init derives the TTL bounds, which cannot exceed cfg.RedisTTL.
+func (c *CacheControlConfig) Init() {
+	c.MinTTL = time.Duration(c.MinTTLMins) * time.Minute
+	c.MaxTTL = time.Duration(c.MaxTTLHours) * time.Hour
+	if c.MaxTTL <= 0 || c.MaxTTL > cfg.RedisTTL {
+		c.MaxTTL = cfg.RedisTTL
+	}
+	if c.MinTTL > c.MaxTTL {
+		c.MinTTL = c.MaxTTL
+	}
+}
+
+// ResultTTL returns how long a result fetched with header stays fresh. When
+// the origin says nothing it is the soft TTL for stale-while-revalidate, or
+// cfg.RedisTTL.
+func (c *CacheControlConfig) ResultTTL(header http.Header) time.Duration {
+	defaultTTL := cfg.RedisTTL
+	if cfg.Stale.Enabled {
+		defaultTTL = cfg.Stale.SoftTTL
+	}
+	if !c.Enabled {
+		return defaultTTL
+	}
+	ttl, ok := HeaderTTL(header, time.Now())
+	if !ok {
+		return defaultTTL
+	}
+	if ttl < c.MinTTL {
+		return c.MinTTL
+	}
+	if ttl > c.MaxTTL {
+		return c.MaxTTL
+	}
+	return ttl
+}
+
+// HeaderTTL returns the freshness lifetime given by Cache-Control s-maxage or
+// max-age, or by Expires, less the response's Age. no-store and no-cache
+// make it zero.
+func HeaderTTL(header http.Header, now time.Time) (time.Duration, bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(strings.ToLower(strings.Join(header["Cache-Control"], ",")), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return 0, true
+		case strings.HasPrefix(directive, "s-maxage="):
+			sMaxAge, _ = strconv.Atoi(strings.Trim(directive[len("s-maxage="):], `"`))
+		case strings.HasPrefix(directive, "max-age="):
+			maxAge, _ = strconv.Atoi(strings.Trim(directive[len("max-age="):], `"`))
+		}
+	}
+
+	var ttl time.Duration
+	switch {
+	case sMaxAge >= 0:
+		ttl = time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		ttl = time.Duration(maxAge) * time.Second
+	case header.Get("Expires") != "":
+		// an invalid date such as "0" means already expired
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl = expires.Sub(date)
+	default:
+		return 0, false
+	}
+
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		ttl -= time.Duration(age) * time.Second
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, true
+}
+
+// AddCacheInfo adds when the result was fetched, how long it stays fresh and
+// the validators for refreshing it to response. The validators belong to u,
+// the URL whose response carried header, which is kept as validatorUrl since
+// "url" may later be replaced by the page's canonical URL.
+func AddCacheInfo(response *rj.Container, u *url.URL, header http.Header) {
+	response.AddValue("fetchedAt", int(time.Now().Unix()))
+	response.AddValue("maxAge", int(cfg.CacheControl.ResultTTL(header).Seconds()))
+	etag, lastModified := header.Get("ETag"), header.Get("Last-Modified")
+	if etag != "" {
+		response.AddValue("etag", etag)
+	}
+	if lastModified != "" {
+		response.AddValue("lastModified", lastModified)
+	}
+	if etag != "" || lastModified != "" {
+		response.AddValue("validatorUrl", u.String())
+	}
+}
+
+// CachedItemFresh reports whether a cached item is within its maxAge. Errors
+// and results cached without one are fresh until the cache expires them.
+func CachedItemFresh(cached *rj.Container) bool {
+	if !cached.HasMember("fetchedAt") || !cached.HasMember("maxAge") {
+		return true
+	}
+	fetchedAt, _ := cached.GetMemberOrNil("fetchedAt").GetInt()
+	maxAge, _ := cached.GetMemberOrNil("maxAge").GetInt()
+	return time.Now().Before(time.Unix(int64(fetchedAt+maxAge), 0))
+}
+
+// RevalidateCached reports whether a stale cached item may be served again
+// because a conditional GET to the URL its validators came from got a 304, in
+// which case its freshness is renewed in the cache under hash.
+func RevalidateCached(ctx context.Context, hash string, cached *rj.Container) bool {
+	etag, _ := cached.GetMemberOrNil("etag").GetString()
+	lastModified, _ := cached.GetMemberOrNil("lastModified").GetString()
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	// results cached before validatorUrl was added were never canonicalized
+	// away from the URL that returned the validators
+	validatorUrl, _ := cached.GetMemberOrNil("validatorUrl").GetString()
+	if validatorUrl == "" {
+		validatorUrl, _ = cached.GetMemberOrNil("url").GetString()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.FetchBudget)
+	defer cancel()
+	header, err := Revalidate(ctx, validatorUrl, etag, lastModified)
+	if err != nil {
+		logger.Warning("Revalidate fail: " + err.Error())
+	}
+	if header == nil {
+		revalidationsCounterVector.WithLabelValues("modified").Inc()
+		return false
+	}
+	revalidationsCounterVector.WithLabelValues("not_modified").Inc()
+
+	// a 304 without caching headers keeps the previous lifetime
+	if header.Get("Cache-Control") != "" || header.Get("Expires") != "" {
+		cached.SetMemberValue("maxAge", int(cfg.CacheControl.ResultTTL(header).Seconds()))
+	}
+	cached.SetMemberValue("fetchedAt", int(time.Now().Unix()))
+	if err := SetResult(hash, cached.String(), cfg.RedisTTL); err != nil {
+		logCacheError("Error saving response in cache", err)
+	}
+	return true
+}
+
+// Revalidate makes a conditional GET for rawUrl and returns the response
+// headers if it was not modified, or nil if it has to be fetched again.
+func Revalidate(ctx context.Context, rawUrl string, etag string, lastModified string) (http.Header, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Policy.Check(u); err != nil {
+		return nil, nil
+	}
+	if cfg.Robots.Enabled {
+		if err := CheckRobots(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+
+	getReq, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, connTrace), "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	getReq.Header.Set("Accept-Encoding", ACCEPT_ENCODING)
+	if etag != "" {
+		getReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		getReq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	result, releaseHost, err := FetchAttempt(ctx, getReq)
+	defer releaseHost()
+	if err != nil {
+		if result != nil {
+			result.Body.Close()
+		}
+		return nil, err
+	}
+	DiscardBody(result.Body)
+	if result.StatusCode != http.StatusNotModified {
+		return nil, nil
+	}
+	return result.Header, nil
+}
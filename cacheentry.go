@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy" // snappy block format
+	"github.com/klauspost/compress/zstd"   // zstd encoder and decoder
+)
+
+const (
+	// CACHE_SCHEMA_VERSION is part of result keys and changes whenever fields
+	// of the link object are added, renamed or change type, so that results
+	// cached with another shape are never read.
+	CACHE_SCHEMA_VERSION = 1
+	// CACHE_EXTRACTOR_VERSION is part of result keys too and changes whenever
+	// parsing extracts different values; results cached by an older extractor
+	// are fetched again and left to expire.
+	CACHE_EXTRACTOR_VERSION = 1
+
+	RESULT_KEY_PREFIX = "link:"
+
+	COMPRESS_NONE   = "none"
+	COMPRESS_SNAPPY = "snappy"
+	COMPRESS_ZSTD   = "zstd"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// CacheHash returns the hash the result for rootUrl is cached under: its
+// host, so that all results for a host can be found together, and the md5 of
+// rootUrl.
+func CacheHash(rootUrl string) string {
+	host := rootUrl
+	if i := strings.IndexAny(rootUrl, "/?"); i >= 0 {
+		host = rootUrl[:i]
+	}
+	return strings.ToLower(host) + "/" + fmt.Sprintf("%x", md5.Sum([]byte(rootUrl)))
+}
+
+// ResultKey returns the cache key of the result for hash. Both versions are
+// in the key, so that after a bump old entries are never read and the purge
+// of a host only finds results of the running version.
+func ResultKey(hash string) string {
+	return RESULT_KEY_PREFIX + "v" + strconv.Itoa(CACHE_SCHEMA_VERSION) + "." + strconv.Itoa(CACHE_EXTRACTOR_VERSION) + ":" + hash
+}
+
+// HostResultsPrefix returns the prefix of the cache keys of all results for
+// host.
+func HostResultsPrefix(host string) string {
+	return ResultKey(strings.ToLower(host) + "/")
+}
+
+// GetResult returns the cached result for hash. Results cached by another
+// version, or that cannot be decoded, are a CacheMiss.
+func GetResult(hash string) (string, error) {
+	entry, err := cache.Get(ResultKey(hash))
+	if err != nil {
+		return "", err
+	}
+	result, err := DecodeResult(entry)
+	if err != nil {
+		if err != CacheMiss {
+			logger.Warning("Dropping unreadable cache entry " + hash + ": " + err.Error())
+		}
+		return "", CacheMiss
+	}
+	return result, nil
+}
+
+// SetResult caches the result JSON for hash, compressed as configured.
+func SetResult(hash string, result string, ttl time.Duration) error {
+	return cache.Set(ResultKey(hash), EncodeResult(result, cfg.Cache.Compression, cfg.Cache.CompressMinBytes), ttl)
+}
+
+// DeleteResult drops the cached result for hash.
+func DeleteResult(hash string) error {
+	return cache.Delete(ResultKey(hash))
+}
+
+// EncodeResult returns the cache entry for a result: a header with the
+// schema and extractor versions and the compression used, then the result.
+// Results shorter than minBytes are not compressed.
+func EncodeResult(result string, compression string, minBytes int) string {
+	if len(result) < minBytes {
+		compression = COMPRESS_NONE
+	}
+	payload := result
+	switch compression {
+	case COMPRESS_SNAPPY:
+		payload = string(snappy.Encode(nil, []byte(result)))
+	case COMPRESS_ZSTD:
+		payload = string(zstdEncoder.EncodeAll([]byte(result), nil))
+	default:
+		compression = COMPRESS_NONE
+	}
+	return strconv.Itoa(CACHE_SCHEMA_VERSION) + "." + strconv.Itoa(CACHE_EXTRACTOR_VERSION) + "." + compression + ":" + payload
+}
+
+// DecodeResult returns the result in a cache entry, whatever compression it
+// was stored with, or CacheMiss if it was cached by another version.
+func DecodeResult(entry string) (string, error) {
+	colon := strings.IndexByte(entry, ':')
+	if colon < 0 {
+		return "", errors.New("missing header")
+	}
+	header := strings.Split(entry[:colon], ".")
+	if len(header) != 3 {
+		return "", errors.New("invalid header " + entry[:colon])
+	}
+	if header[0] != strconv.Itoa(CACHE_SCHEMA_VERSION) || header[1] != strconv.Itoa(CACHE_EXTRACTOR_VERSION) {
+		return "", CacheMiss
+	}
+
+	payload := entry[colon+1:]
+	switch header[2] {
+	case COMPRESS_NONE:
+		return payload, nil
+	case COMPRESS_SNAPPY:
+		result, err := snappy.Decode(nil, []byte(payload))
+		return string(result), err
+	case COMPRESS_ZSTD:
+		result, err := zstdDecoder.DecodeAll([]byte(payload), nil)
+		return string(result), err
+	default:
+		return "", errors.New("unknown compression " + header[2])
+	}
+}
+
+// prefixCache adds a prefix to every key of a Cache, so that several
+// deployments can share one redis database.
+type prefixCache struct {
+	prefix string
+	Cache
+}
+
+func (c prefixCache) Get(key string) (string, error) {
+	return c.Cache.Get(c.prefix + key)
+}
+
+func (c prefixCache) Set(key string, value string, ttl time.Duration) error {
+	return c.Cache.Set(c.prefix+key, value, ttl)
+}
+
+func (c prefixCache) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	return c.Cache.SetNX(c.prefix+key, value, ttl)
+}
+
+func (c prefixCache) Delete(key string) error {
+	return c.Cache.Delete(c.prefix + key)
+}
+
+func (c prefixCache) TTL(key string) (time.Duration, error) {
+	return c.Cache.TTL(c.prefix + key)
+}
+
+func (c prefixCache) DeletePrefix(prefix string) (int, error) {
+	return c.Cache.DeletePrefix(c.prefix + prefix)
+}
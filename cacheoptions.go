@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	rj "github.com/bottlenose-inc/rapidjson" // faster json handling
+)
+
+var (
+	NotCached = errors.New("Not cached")
+)
+
+// CacheOptions are the options of a request item deciding how its result is
+// cached and fetched, set for the whole batch next to "request" or for
+// single items next to "url". NoCache skips reading the cache, NoStore skips
+// writing the fetched result to it, MaxAge only accepts cached results
+// fetched at most that long ago, a MaxAge of 0 being NoCache, and
+// OnlyIfCached never fetches, failing the item with NotCached on a miss.
+// HeadOnly stops parsing fetched pages at the end of <head>, for callers
+// that only want the fields found there; such results are flagged headOnly
+// and only served to other HeadOnly items.
+type CacheOptions struct {
+	NoCache      bool
+	NoStore      bool
+	OnlyIfCached bool
+	HeadOnly     bool
+	MaxAge       time.Duration
+}
+
+// ParseCacheOptions reads the cache options set in ct over defaults.
+func ParseCacheOptions(ct *rj.Container, defaults CacheOptions) (CacheOptions, error) {
+	opts := defaults
+	flags := []struct {
+		name  string
+		value *bool
+	}{
+		{"noCache", &opts.NoCache},
+		{"noStore", &opts.NoStore},
+		{"onlyIfCached", &opts.OnlyIfCached},
+		{"headOnly", &opts.HeadOnly},
+	}
+	for _, flag := range flags {
+		if !ct.HasMember(flag.name) {
+			continue
+		}
+		value, err := ct.GetMemberOrNil(flag.name).GetBool()
+		if err != nil {
+			return opts, errors.New(flag.name + " must be a boolean")
+		}
+		*flag.value = value
+	}
+	if ct.HasMember("maxAge") {
+		maxAge, err := ct.GetMemberOrNil("maxAge").GetInt()
+		if err != nil || maxAge < 0 {
+			return opts, errors.New("maxAge must be a number of seconds")
+		}
+		// as in HTTP, a maxAge of 0 only accepts a fresh fetch
+		if maxAge == 0 {
+			opts.NoCache = true
+		}
+		opts.MaxAge = time.Duration(maxAge) * time.Second
+	}
+	return opts, nil
+}
+
+// Accepts reports whether a cached item is recent enough for MaxAge, and
+// complete enough unless HeadOnly. Items cached without fetchedAt, such as
+// errors, are of unknown age and only accepted without MaxAge.
+func (o CacheOptions) Accepts(cached *rj.Container) bool {
+	if !o.HeadOnly && cached.HasMember("headOnly") {
+		return false
+	}
+	if o.MaxAge <= 0 {
+		return true
+	}
+	if !cached.HasMember("fetchedAt") {
+		return false
+	}
+	fetchedAt, _ := cached.GetMemberOrNil("fetchedAt").GetInt()
+	return time.Since(time.Unix(int64(fetchedAt), 0)) <= o.MaxAge
+}
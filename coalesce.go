@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	rj "github.com/bottlenose-inc/rapidjson" // faster json handling
+)
+
+const (
+	FETCH_LOCK_PREFIX = "fetch:"
+	FETCH_DONE_PREFIX = "fetched:" // token of the lock holder whose result is cached
+)
+
+var (
+	inflightLock sync.Mutex
+	inflight     = make(map[string]*inflightFetch) // by rootUrl hash
+)
+
+// CoalesceConfig configures sharing fetches across instances. With
+// FleetLock set, an instance fetching a URL holds a redis lock on it, and
+// other instances poll redis every PollMs for the result it caches instead
+// of fetching the URL themselves.
+type CoalesceConfig struct {
+	FleetLock bool `yaml:"fleetLock"`
+	PollMs    int  `yaml:"pollMs"`
+
+	Poll time.Duration
+}
+
+// inflightFetch is a fetch shared by every concurrent request for a URL.
+type inflightFetch struct {
+	done    chan struct{}
+	result  string
+	chain   *RedirectChain
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// CoalesceFetch runs fetch once for concurrent callers with the same key and
+// returns its result to all of them. The fetch has its own context, which is
+// cancelled once every caller has given up, and records its hops in chain,
+// the chain of the caller that started it. A caller whose ctx is done stops
+// waiting and gets the matching error with a copy of that chain so far. A
+// panic in fetch fails it with an unknown error.
+func CoalesceFetch(ctx context.Context, key string, chain *RedirectChain, fetch func(context.Context) string) (string, *RedirectChain, error) {
+	inflightLock.Lock()
+	f, shared := inflight[key]
+	if shared {
+		fetchesDedupCounterVector.WithLabelValues("process").Inc()
+	} else {
+		fetchCtx, cancel := context.WithCancel(context.Background())
+		f = &inflightFetch{done: make(chan struct{}), chain: chain, cancel: cancel}
+		inflight[key] = f
+		go func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					errorJson := rj.NewDoc()
+					SetItemError(errorJson.GetContainerNewObj(), PanicError(recovered))
+					f.result = errorJson.String()
+					errorJson.Free()
+				}
+				inflightLock.Lock()
+				if inflight[key] == f {
+					delete(inflight, key)
+				}
+				inflightLock.Unlock()
+				cancel()
+				close(f.done)
+			}()
+			f.result = fetch(fetchCtx)
+		}()
+	}
+	f.waiters++
+	inflightLock.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, nil, nil
+	case <-ctx.Done():
+		inflightLock.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// nobody is waiting any more; later callers start a new fetch
+			f.cancel()
+			if inflight[key] == f {
+				delete(inflight, key)
+			}
+		}
+		inflightLock.Unlock()
+		return "", f.chain.Copy(), FetchContextError(ctx)
+	}
+}
+
+// FleetFetch runs fetch for the URL with hash while holding its redis fetch
+// lock, or waits for the result of the instance holding it. fetch reports
+// whether it cached its result; only then does the holder mark the cached
+// result as its own, and waiting instances only take a result so marked, never
+// one cached before. Without cfg.Coalesce.FleetLock, or if redis fails, it
+// just runs fetch.
+func FleetFetch(ctx context.Context, hash string, fetch func(context.Context) (string, bool)) string {
+	if !cfg.Coalesce.FleetLock {
+		respStr, _ := fetch(ctx)
+		return respStr
+	}
+
+	lockKey := FETCH_LOCK_PREFIX + hash
+	token := lockToken()
+	counted := false
+	for {
+		locked, err := cache.SetNX(lockKey, token, cfg.FetchBudget+cfg.Coalesce.Poll)
+		if err != nil {
+			logCacheError("Error taking fetch lock in cache", err)
+			respStr, _ := fetch(ctx)
+			return respStr
+		}
+		if locked {
+			break
+		}
+		holder, err := cache.Get(lockKey)
+		if err != nil {
+			// released in the meantime, try to take it
+			continue
+		}
+		if !counted {
+			fetchesDedupCounterVector.WithLabelValues("fleet").Inc()
+			counted = true
+		}
+
+		// another instance is fetching the URL; wait for its result, or for
+		// the lock to be released or expire and take it over
+		if respStr, ok := awaitFleetFetch(ctx, hash, holder); ok {
+			return respStr
+		}
+		if ctx.Err() != nil {
+			return ""
+		}
+	}
+
+	defer func() {
+		// only release the lock if it has not expired and been taken over
+		if current, err := cache.Get(lockKey); err == nil && current == token {
+			cache.Delete(lockKey)
+		}
+	}()
+	respStr, stored := fetch(ctx)
+	if stored {
+		if err := cache.Set(FETCH_DONE_PREFIX+hash, token, cfg.FetchBudget+cfg.Coalesce.Poll); err != nil {
+			logCacheError("Error marking fetch done in cache", err)
+		}
+	}
+	return respStr
+}
+
+// awaitFleetFetch polls redis every cfg.Coalesce.Poll until the instance
+// holding the fetch lock for hash with token holder has cached its result,
+// and returns it. It gives up when ctx is done or the lock is released or
+// taken over without a result.
+func awaitFleetFetch(ctx context.Context, hash string, holder string) (string, bool) {
+	for {
+		timer := time.NewTimer(cfg.Coalesce.Poll)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", false
+		}
+		// the holder marks its result done before releasing the lock, so the
+		// lock is read first
+		current, lockErr := cache.Get(FETCH_LOCK_PREFIX + hash)
+		if done, err := cache.Get(FETCH_DONE_PREFIX + hash); err == nil && done == holder {
+			if respStr, err := GetResult(hash); err == nil {
+				return respStr, true
+			}
+		}
+		if lockErr != nil || current != holder {
+			return "", false
+		}
+	}
+}
+
+// lockToken returns a random value identifying the holder of a redis lock.
+func lockToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"time"
 )
 
@@ -10,20 +11,56 @@ type Config struct {
 	RedisTTLDays      int      `yaml:"redisTTLdays"`
 	RedisErrorTTLMins int      `yaml:"redisErrorTTLmins"`
 	HTTPGetTimeoutSec int      `yaml:"httpGetTimeoutsec"`
+	FetchBudgetSec    int      `yaml:"fetchBudgetSec"`
 	MaxRedirect       int      `yaml:"maxRedirect"`
+	FollowMetaRefresh bool     `yaml:"followMetaRefresh"`
+	MetaRefreshMaxSec int      `yaml:"metaRefreshMaxSec"`
 	MaxImgURL         int      `yaml:"maxImgURL"`
 	DescMaxWords      int      `yaml:"descMaxWords"`
 	DescMaxChars      int      `yaml:"descMaxChars"`
 	ProviderNamesFile string   `yaml:"providerNamesFile"`
+	UnwrapRulesFile   string   `yaml:"unwrapRulesFile"`
+	UnwrapReloadSec   int      `yaml:"unwrapReloadSec"`
 	MultiTags         []string `yaml:"multiTags"`
 	KeywordsTags      []string `yaml:"keywordsTags"`
-	Blacklist         []string `yaml:"blacklist"`
+	Policy            Policy   `yaml:"policy"`
+	Blacklist         []string `yaml:"blacklist"` // deprecated, see Policy.AddBlacklist
+	AllowedCIDRs      []string `yaml:"allowedCIDRs"`
 	RedisHost         string   `yaml:"redisHost"`
 	RedisDB           int      `yaml:"redisDB"`
 
+	ErrorTTLMins map[string]int `yaml:"errorTTLmins"`
+
+	MaxCompressedBytes int64 `yaml:"maxCompressedBytes"`
+	MaxBodyBytes       int64 `yaml:"maxBodyBytes"`
+
+	MaxConcurrentFetches int `yaml:"maxConcurrentFetches"`
+	BatchConcurrency     int `yaml:"batchConcurrency"`
+
+	Transport  TransportConfig  `yaml:"transport"`
+	Retry      RetryConfig      `yaml:"retry"`
+	Robots     RobotsConfig     `yaml:"robots"`
+	HostLimits HostLimitsConfig `yaml:"hostLimits"`
+	Breaker    BreakerConfig    `yaml:"breaker"`
+
+	JSRedirects JSRedirectConfig `yaml:"jsRedirects"`
+
+	Redis        RedisConfig        `yaml:"redis"`
+	Cache        CacheConfig        `yaml:"cache"`
+	CacheControl CacheControlConfig `yaml:"cacheControl"`
+	Stale        StaleConfig        `yaml:"staleWhileRevalidate"`
+	Coalesce     CoalesceConfig     `yaml:"coalesce"`
+
+	Admin AdminConfig `yaml:"admin"`
+
 	RedisTTL       time.Duration
 	RedisErrorTTL  time.Duration
+	ErrorTTLs      map[string]time.Duration
 	HTTPGetTimeout time.Duration
+	FetchBudget    time.Duration
+
+	MetaRefreshMaxDelay time.Duration
 
 	MultiTagsMap map[string]bool
+	AllowedNets  []*net.IPNet
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+var (
+	// reservedNets are ranges not covered by the net.IP helpers below that
+	// should never be reachable from a fetched link.
+	reservedNets = parseCIDRs(
+		"0.0.0.0/8",       // "this" network
+		"100.64.0.0/10",   // carrier-grade NAT
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // TEST-NET-1
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // TEST-NET-2
+		"203.0.113.0/24",  // TEST-NET-3
+		"240.0.0.0/4",     // reserved, including broadcast
+		"64:ff9b::/96",    // NAT64, may map onto private IPv4
+		"64:ff9b:1::/48",  // local-use NAT64
+		"2001:db8::/32",   // documentation
+		"2002::/16",       // 6to4, may embed private IPv4
+	)
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// CheckDialAddress is used as the net.Dialer Control function. It runs after
+// the host has been resolved, on the exact address being connected to, so a
+// host that resolves differently between lookup and connect is still caught.
+func CheckDialAddress(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || IsBlockedIP(ip) {
+		return AddressBlocked
+	}
+	return nil
+}
+
+// IsBlockedIP reports whether ip is a private, loopback, link-local or
+// otherwise reserved address that is not in cfg.AllowedNets.
+func IsBlockedIP(ip net.IP) bool {
+	for _, ipNet := range cfg.AllowedNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, ipNet := range reservedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	rj "github.com/bottlenose-inc/rapidjson" // faster json handling
+)
+
+// Error codes reported in the errorCode of failed items. They are stable
+// and safe to match on, unlike the error messages.
+const (
+	ERROR_BLACKLISTED              = "blacklisted"
+	ERROR_PRIVATE_ADDRESS          = "private_address"
+	ERROR_ROBOTS                   = "robots_disallowed"
+	ERROR_CRAWL_DELAY              = "crawl_delayed"
+	ERROR_RATE_LIMITED             = "rate_limited"
+	ERROR_CIRCUIT_OPEN             = "circuit_open"
+	ERROR_DEADLINE                 = "deadline_exceeded"
+	ERROR_CANCELLED                = "cancelled"
+	ERROR_HTTP_STATUS              = "http_status"
+	ERROR_TIMEOUT                  = "timeout"
+	ERROR_DNS                      = "dns"
+	ERROR_TLS                      = "tls"
+	ERROR_CONNECTION               = "connection"
+	ERROR_TOO_LARGE                = "too_large"
+	ERROR_UNSUPPORTED_CONTENT_TYPE = "unsupported_content_type"
+	ERROR_UNSUPPORTED_ENCODING     = "unsupported_content_encoding"
+	ERROR_TOO_MANY_REDIRECTS       = "too_many_redirects"
+	ERROR_PARSE                    = "parse_error"
+	ERROR_INVALID_REQUEST          = "invalid_request"
+	ERROR_NOT_CACHED               = "not_cached"
+	ERROR_UNKNOWN                  = "unknown"
+)
+
+var (
+	MissingURL = &FetchError{Code: ERROR_INVALID_REQUEST, Msg: "Missing url key"}
+
+	errorCodes = []string{
+		ERROR_BLACKLISTED, ERROR_PRIVATE_ADDRESS, ERROR_ROBOTS, ERROR_CRAWL_DELAY,
+		ERROR_RATE_LIMITED, ERROR_CIRCUIT_OPEN, ERROR_DEADLINE, ERROR_CANCELLED,
+		ERROR_HTTP_STATUS, ERROR_TIMEOUT, ERROR_DNS, ERROR_TLS, ERROR_CONNECTION,
+		ERROR_TOO_LARGE, ERROR_UNSUPPORTED_CONTENT_TYPE, ERROR_UNSUPPORTED_ENCODING,
+		ERROR_TOO_MANY_REDIRECTS, ERROR_PARSE, ERROR_INVALID_REQUEST, ERROR_NOT_CACHED,
+		ERROR_UNKNOWN,
+	}
+	statusTTLKey = regexp.MustCompile(`\Ahttp_[1-5]([0-9]{2}|xx)\z`)
+)
+
+// FetchError is a failure whose message varies but whose error code is
+// known where it happens. Status is the upstream HTTP status, if any.
+type FetchError struct {
+	Code   string
+	Status int
+	Msg    string
+}
+
+func (e *FetchError) Error() string {
+	return e.Msg
+}
+
+// PanicError logs a panic recovered while processing an item, with its
+// stack, and returns the error reported for the item instead.
+func PanicError(recovered interface{}) *FetchError {
+	logger.Error(fmt.Sprintf("Recovered panic: %v\n%s", recovered, debug.Stack()))
+	return &FetchError{Code: ERROR_UNKNOWN, Msg: "Internal error"}
+}
+
+// ClassifyError returns the error code of an item error, the upstream HTTP
+// status if there was one, and whether the item may succeed if requested
+// again later.
+func ClassifyError(err error) (string, int, bool) {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.Code, fetchErr.Status, fetchErr.Code == ERROR_HTTP_STATUS && IsRetryableStatus(fetchErr.Status)
+	}
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return ERROR_BLACKLISTED, 0, false
+	}
+
+	switch {
+	case errors.Is(err, AddressBlocked):
+		return ERROR_PRIVATE_ADDRESS, 0, false
+	case errors.Is(err, RobotsDisallowed):
+		return ERROR_ROBOTS, 0, false
+	case errors.Is(err, CrawlDelayed):
+		return ERROR_CRAWL_DELAY, 0, true
+	case errors.Is(err, RateLimited):
+		return ERROR_RATE_LIMITED, 0, true
+	case errors.Is(err, CircuitOpen):
+		return ERROR_CIRCUIT_OPEN, 0, true
+	case errors.Is(err, DeadlineExceeded):
+		return ERROR_DEADLINE, 0, true
+	case errors.Is(err, FetchCancelled):
+		return ERROR_CANCELLED, 0, true
+	case errors.Is(err, NotCached):
+		return ERROR_NOT_CACHED, 0, true
+	}
+
+	// certificate problems are not worth retrying, unlike handshake timeouts
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &recordErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &invalidErr) {
+		return ERROR_TLS, 0, false
+	}
+	if class := TransientErrorClass(err); class != "" {
+		return class, 0, true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ERROR_DNS, 0, false
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Op == "parse" {
+		return ERROR_PARSE, 0, false
+	}
+	return ERROR_UNKNOWN, 0, false
+}
+
+// IsRetryableStatus reports whether an upstream status is likely to change
+// when requested again later.
+func IsRetryableStatus(status int) bool {
+	return status == 408 || status == 425 || status == 429 || status >= 500
+}
+
+// SetItemError adds the error for a failed item to response with its error
+// code, upstream status and retryable flag, along with the matching rule
+// when the URL was refused by the policy.
+func SetItemError(response *rj.Container, err error) {
+	code, status, retryable := ClassifyError(err)
+	itemErrorsCounterVector.WithLabelValues(code).Inc()
+
+	response.AddValue("error", err.Error())
+	response.AddValue("errorCode", code)
+	if status != 0 {
+		response.AddValue("upstreamStatus", status)
+	}
+	response.AddValue("retryable", retryable)
+	if policyErr, ok := err.(*PolicyError); ok {
+		response.AddValue("blockedBy", policyErr.Rule)
+	}
+}
+
+// InitErrorTTLs validates the error TTL table, keyed by error code or by
+// upstream status as "http_404" or "http_5xx", and converts it to durations.
+func InitErrorTTLs(ttlMins map[string]int) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	for key, mins := range ttlMins {
+		known := statusTTLKey.MatchString(key)
+		for _, code := range errorCodes {
+			known = known || key == code
+		}
+		if !known {
+			return nil, errors.New("invalid errorTTLmins key: " + key)
+		}
+		if mins <= 0 {
+			return nil, errors.New("errorTTLmins for " + key + " must be a positive number of minutes")
+		}
+		ttls[key] = time.Duration(mins) * time.Minute
+	}
+	return ttls, nil
+}
+
+// ErrorTTL returns how long an item error is cached: the TTL configured for
+// its exact upstream status, its status class or its error code, in that
+// order, or cfg.RedisErrorTTL.
+func ErrorTTL(err error) time.Duration {
+	code, status, _ := ClassifyError(err)
+	keys := []string{code}
+	if status != 0 {
+		s := strconv.Itoa(status)
+		keys = []string{"http_" + s, "http_" + s[:1] + "xx", code}
+	}
+	for _, key := range keys {
+		if ttl, ok := cfg.ErrorTTLs[key]; ok {
+			return ttl
+		}
+	}
+	return cfg.RedisErrorTTL
+}
+
+// CachedItemValid reports whether the item cached under hash may be served.
+// Errors for URLs refused by the policy are only valid for the policy they
+// were cached under, which is kept next to them.
+func CachedItemValid(hash string, cached *rj.Container) bool {
+	code, _ := cached.GetMemberOrNil("errorCode").GetString()
+	if code != ERROR_BLACKLISTED {
+		return true
+	}
+	version, err := cache.Get(POLICY_KEY_PREFIX + hash)
+	return err == nil && version == cfg.Policy.Version
+}
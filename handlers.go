@@ -81,6 +81,30 @@ func NotFound(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Ready reports whether the service is ready for requests, which it is not
+// while the cache is unavailable. It is meant for health checks and not
+// counted as a request.
+func Ready(w http.ResponseWriter, r *http.Request) {
+	readyJson := rj.NewDoc()
+	defer readyJson.Free()
+	readyCt := readyJson.GetContainerNewObj()
+
+	status := http.StatusOK
+	if err := cache.Ready(); err != nil {
+		status = http.StatusServiceUnavailable
+		readyCt.AddValue("ready", false)
+		readyCt.AddValue("error", err.Error())
+	} else {
+		readyCt.AddValue("ready", true)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write(readyJson.Bytes()); err != nil {
+		logger.Error("Error writing ready response: " + err.Error())
+	}
+}
+
 // Usage sends the usage information response.
 func Usage(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
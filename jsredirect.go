@@ -0,0 +1,54 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// assignments to or replace/assign calls on window.location and friends,
+	// with a string literal target
+	jsRedirectPattern = regexp.MustCompile(`\b(?:(?:window|document|self|top)\.)?location(?:\.href)?\s*=\s*["']([^"']+)["']|\blocation\.(?:replace|assign)\(\s*["']([^"']+)["']\s*\)`)
+)
+
+// JSRedirectConfig configures javascript redirect detection. Redirects are
+// only taken from inline scripts of at most MaxScriptBytes, on pages whose
+// body has at most MaxPageTextChars of text. An empty Hosts list enables
+// detection for all hosts, otherwise for the listed domains and their
+// subdomains.
+type JSRedirectConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	Hosts            []string `yaml:"hosts"`
+	MaxScriptBytes   int      `yaml:"maxScriptBytes"`
+	MaxPageTextChars int      `yaml:"maxPageTextChars"`
+}
+
+// AppliesTo reports whether javascript redirects are detected for host.
+func (c *JSRedirectConfig) AppliesTo(host string) bool {
+	if !c.Enabled {
+		return false
+	}
+	if len(c.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, domain := range c.Hosts {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindJSRedirect returns the target of the first location redirect in js, or
+// "" if there is none.
+func FindJSRedirect(js string) string {
+	match := jsRedirectPattern.FindStringSubmatch(js)
+	if match == nil {
+		return ""
+	}
+	if match[1] != "" {
+		return match[1]
+	}
+	return match[2]
+}
@@ -2,16 +2,15 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
-	"crypto/md5"
+	"context"
 	"errors"
-	"fmt"
-	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/asaskevich/govalidator"
@@ -20,17 +19,6 @@ import (
 	"golang.org/x/net/html/charset"
 )
 
-var (
-	redirects = []*regexp.Regexp{
-		regexp.MustCompile(`\Ahttp://adf.ly/[0-9]*/([\.0-9a-zA-Z:/-]*)`),
-		regexp.MustCompile(`\Ahttp://weightless.mysharebar.com/view[?]iframe=([\.0-9a-zA-Z:/-]*)`),
-	}
-)
-
-const (
-	CONTENT_LENGTH_LIMIT_BYTES = 1024 * 512 // 512 MB
-)
-
 func Links(w http.ResponseWriter, r *http.Request) {
 	body, err := GetRequests(w, r)
 	if err != nil {
@@ -58,72 +46,85 @@ func Links(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respCode := http.StatusOK
-	responses := rj.NewDoc()
-	defer responses.Free()
-	responsesCt := responses.GetContainerNewObj()
-	var responsesArray []*rj.Container
-	for _, request := range requests {
-		response := responses.NewContainerObj()
+	// fetches stop when the client disconnects, or at its optional deadline
+	ctx := r.Context()
+	if requestCt.HasMember("deadlineMs") {
+		deadline, _ := requestCt.GetMemberOrNil("deadlineMs").GetInt()
+		if deadline <= 0 {
+			invalidRequestsCounter.Inc()
+			SendErrorResponse(w, "Unable to parse request - deadlineMs must be a positive number", http.StatusBadRequest)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(deadline)*time.Millisecond)
+		defer cancel()
+	}
+
+	// cache options for the batch, which items may override
+	batchOpts, err := ParseCacheOptions(requestCt, CacheOptions{})
+	if err != nil {
+		invalidRequestsCounter.Inc()
+		SendErrorResponse(w, "Unable to parse request - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// fetch each item on its own goroutine, bounded by the per-batch limit;
+	// results are collected by index so responses keep the input order
+	results := make([]linkResult, len(requests))
+	batchSlots := make(chan struct{}, cfg.BatchConcurrency)
+	var wg sync.WaitGroup
+	for i, request := range requests {
 		req, err := request.GetMember("url")
 		if err != nil {
-			response.AddValue("error", "Missing url key")
+			errorJson := rj.NewDoc()
+			SetItemError(errorJson.GetContainerNewObj(), MissingURL)
 			//logger.Error("Request missing URL key: " + request.String())
-			responsesArray = append(responsesArray, response)
-			respCode = http.StatusBadRequest
+			results[i] = linkResult{docs: []*rj.Doc{errorJson}, respCode: http.StatusBadRequest}
 			incUnsuccessfulCounter()
 			continue
 		}
-
-		// parse request URL, create hash for redis
-		reqStr, err := req.GetString()
-		reqStr = CheckRedirectURL(reqStr)
-		u, err := url.Parse(reqStr)
+		reqStr, _ := req.GetString()
+		opts, err := ParseCacheOptions(request, batchOpts)
 		if err != nil {
-			response.AddValue("error", "URL parse error")
-			logger.Warning("url Parse error: " + reqStr)
-			respCode = http.StatusNonAuthoritativeInfo
+			errorJson := rj.NewDoc()
+			SetItemError(errorJson.GetContainerNewObj(), &FetchError{Code: ERROR_INVALID_REQUEST, Msg: err.Error()})
+			results[i] = linkResult{docs: []*rj.Doc{errorJson}, respCode: http.StatusBadRequest}
 			incUnsuccessfulCounter()
 			continue
 		}
-		rootUrl := u.Host + u.Path
-		u.RawQuery = CleanQuery(u)
-		if u.RawQuery != "" {
-			rootUrl = rootUrl + "?" + u.RawQuery
-		}
-		hash := fmt.Sprintf("%x", md5.Sum([]byte(rootUrl)))
-
-		// check redis
-		respStr, err := redisClient.Get(hash).Result()
-		if err == nil {
-			cachedJson, _ := rj.NewParsedStringJson(respStr)
-			defer cachedJson.Free()
-			response.SetContainer(cachedJson.GetContainer())
-			response.AddValue("cacheHit", true)
-			incCacheHitCounter()
-		} else {
-			err = FetchUrl(reqStr, u, rootUrl, 0, response)
 
-			if err != nil {
-				logger.Warning("FetchUrl fail: " + err.Error())
-				incUnsuccessfulCounter()
-				response.AddValue("error", err.Error())
-				respCode = http.StatusNonAuthoritativeInfo
-				redisErr := redisClient.Set(hash, response.String(), cfg.RedisErrorTTL).Err()
-				if redisErr != nil {
-					logger.Error("Error saving response in Redis: " + redisErr.Error())
-				}
-			} else {
-				err = redisClient.Set(hash, response.String(), cfg.RedisTTL).Err()
-				if err != nil {
-					logger.Error("Error saving response in Redis: " + err.Error())
+		wg.Add(1)
+		batchSlots <- struct{}{}
+		go func(i int, reqStr string, opts CacheOptions) {
+			defer wg.Done()
+			defer func() { <-batchSlots }()
+			// a panic fails its item instead of the whole process
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					errorJson := rj.NewDoc()
+					SetItemError(errorJson.GetContainerNewObj(), PanicError(recovered))
+					results[i] = linkResult{docs: []*rj.Doc{errorJson}, respCode: http.StatusNonAuthoritativeInfo}
+					incUnsuccessfulCounter()
 				}
+			}()
+			results[i] = ProcessLink(ctx, reqStr, opts)
+		}(i, reqStr, opts)
+	}
+	wg.Wait()
 
-				response.AddValue("cacheHit", false)
-				incCacheMissCounter()
-			}
+	respCode := http.StatusOK
+	responses := rj.NewDoc()
+	defer responses.Free()
+	responsesCt := responses.GetContainerNewObj()
+	var responsesArray []*rj.Container
+	for _, result := range results {
+		defer result.Free()
+		if result.respCode != http.StatusOK {
+			respCode = result.respCode
 		}
 
+		response := responses.NewContainerObj()
+		response.SetContainer(result.docs[0].GetContainer())
 		errored := response.HasMember("error")
 		if errored {
 			responsesArray = append(responsesArray, response)
@@ -134,8 +135,6 @@ func Links(w http.ResponseWriter, r *http.Request) {
 			link.AddMember("link", response)
 			responsesArray = append(responsesArray, link)
 		}
-
-		logProcessed()
 	}
 
 	// Send response
@@ -152,17 +151,277 @@ func Links(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func FetchUrl(req string, u *url.URL, rootUrl string, redirectCount int, response *rj.Container) error {
+// linkResult is the outcome of processing a single request item. Items are
+// built in their own documents so that they can be processed concurrently;
+// the first document holds the item, any others are kept alive until the
+// batch response has been written.
+type linkResult struct {
+	docs     []*rj.Doc
+	respCode int
+}
+
+// Free releases the documents held by the result.
+func (r linkResult) Free() {
+	for _, doc := range r.docs {
+		doc.Free()
+	}
+}
+
+// ProcessLink resolves a single requested URL, either from the cache or by
+// fetching it within cfg.FetchBudget as opts allow, and returns the
+// resulting link or error object.
+func ProcessLink(ctx context.Context, reqStr string, opts CacheOptions) linkResult {
+	responseJson := rj.NewDoc()
+	response := responseJson.GetContainerNewObj()
+	result := linkResult{docs: []*rj.Doc{responseJson}, respCode: http.StatusOK}
+
+	// parse request URL, create hash for the cache
+	chain := &RedirectChain{}
+	reqStr = chain.Unwrap(reqStr)
+	u, rootUrl, hash, err := NormalizeURL(reqStr)
+	if err != nil {
+		SetItemError(response, &FetchError{Code: ERROR_PARSE, Msg: "URL parse error"})
+		logger.Warning("url Parse error: " + reqStr)
+		result.respCode = http.StatusNonAuthoritativeInfo
+		incUnsuccessfulCounter()
+		return result
+	}
+
+	// check policy before the cache so rule changes apply immediately
+	if err := cfg.Policy.Check(u); err != nil {
+		SetItemError(response, err)
+		result.respCode = http.StatusNonAuthoritativeInfo
+		incUnsuccessfulCounter()
+		logProcessed()
+		return result
+	}
+
+	// check the cache; results past their TTL are either served stale while they
+	// are refreshed in the background, or revalidated first
+	var cachedJson *rj.Doc
+	var respStr string
+	stale := false
+	if !opts.NoCache {
+		respStr, err = GetResult(hash)
+		if err == nil {
+			cachedJson, _ = rj.NewParsedStringJson(respStr)
+			result.docs = append(result.docs, cachedJson)
+		}
+	}
+	if cachedJson != nil {
+		cached := cachedJson.GetContainer()
+		switch {
+		case !CachedItemValid(hash, cached), !opts.Accepts(cached):
+			cachedJson = nil
+		case CachedItemFresh(cached):
+		case opts.OnlyIfCached:
+			// served as it is, not even revalidated
+			stale = true
+		case cfg.Stale.Enabled:
+			stale = true
+			refreshU := *u
+			go RefreshStale(reqStr, &refreshU, rootUrl, hash, respStr, chain.Copy())
+		case !RevalidateCached(ctx, hash, cached):
+			cachedJson = nil
+		}
+	}
+	if cachedJson != nil {
+		response.SetContainer(cachedJson.GetContainer())
+		response.AddValue("cacheHit", true)
+		if stale {
+			response.AddValue("stale", true)
+		}
+		incCacheHitCounter()
+	} else if opts.OnlyIfCached {
+		SetItemError(response, NotCached)
+		incUnsuccessfulCounter()
+		result.respCode = http.StatusNonAuthoritativeInfo
+		response.AddValue("cacheHit", false)
+		incCacheMissCounter()
+	} else {
+		// concurrent requests for the URL share a single fetch, across
+		// instances with the fleet lock, except those whose result must not
+		// be stored
+		var fetchedStr string
+		var fetchChain *RedirectChain
+		var err error
+		if opts.NoStore {
+			fetchedStr, _ = FetchAndCache(ctx, reqStr, u, rootUrl, hash, chain, opts)
+		} else if opts.HeadOnly {
+			// head only fetches are not shared with those wanting the whole page
+			fetchedStr, fetchChain, err = CoalesceFetch(ctx, hash+"#head", chain, func(ctx context.Context) string {
+				fetchedStr, _ := FetchAndCache(ctx, reqStr, u, rootUrl, hash, chain, opts)
+				return fetchedStr
+			})
+		} else {
+			fetchedStr, fetchChain, err = CoalesceFetch(ctx, hash, chain, func(ctx context.Context) string {
+				return FleetFetch(ctx, hash, func(ctx context.Context) (string, bool) {
+					return FetchAndCache(ctx, reqStr, u, rootUrl, hash, chain, opts)
+				})
+			})
+		}
+		if err != nil {
+			// the caller gave up waiting; report the fetch so far
+			fetchChain.AddTo(responseJson, response)
+			SetItemError(response, err)
+		} else {
+			fetchedJson, _ := rj.NewParsedStringJson(fetchedStr)
+			result.docs = append(result.docs, fetchedJson)
+			response.SetContainer(fetchedJson.GetContainer())
+		}
+		if response.HasMember("error") {
+			incUnsuccessfulCounter()
+			result.respCode = http.StatusNonAuthoritativeInfo
+		}
+		response.AddValue("cacheHit", false)
+		incCacheMissCounter()
+	}
+
+	logProcessed()
+	return result
+}
+
+// WholePageCached reports whether the result cached under hash is a whole
+// page, rather than an error or a head only result.
+func WholePageCached(hash string) bool {
+	cachedStr, err := GetResult(hash)
+	if err != nil {
+		return false
+	}
+	cachedJson, err := rj.NewParsedStringJson(cachedStr)
+	if err != nil {
+		return false
+	}
+	defer cachedJson.Free()
+	cached := cachedJson.GetContainer()
+	return !cached.HasMember("headOnly") && !cached.HasMember("error")
+}
+
+// NormalizeURL parses an unwrapped requested URL and strips tracking
+// parameters from its query. It returns the URL, its rootUrl (host, path
+// and cleaned query) and the hash its result is cached under.
+func NormalizeURL(reqStr string) (*url.URL, string, string, error) {
+	u, err := url.Parse(reqStr)
+	if err != nil {
+		return nil, "", "", err
+	}
+	rootUrl := u.Host + u.Path
+	u.RawQuery = CleanQuery(u)
+	if u.RawQuery != "" {
+		rootUrl = rootUrl + "?" + u.RawQuery
+	}
+	return u, rootUrl, CacheHash(rootUrl), nil
+}
+
+// FetchAndCache fetches a requested URL within cfg.FetchBudget, saves the
+// resulting link or error object in the cache under hash unless opts.NoStore
+// is set, and returns it and whether it was saved. Head only results never
+// replace a whole page result.
+func FetchAndCache(ctx context.Context, reqStr string, u *url.URL, rootUrl string, hash string, chain *RedirectChain, opts CacheOptions) (string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.FetchBudget)
+	defer cancel()
+	if opts.HeadOnly {
+		ctx = WithHeadOnly(ctx)
+	}
+	store := !opts.NoStore && !(opts.HeadOnly && WholePageCached(hash))
+	responseJson := rj.NewDoc()
+	defer responseJson.Free()
+	response := responseJson.GetContainerNewObj()
+
+	stored := false
+	err := FetchItem(ctx, reqStr, u, rootUrl, chain, responseJson, response)
+	if err != nil {
+		logger.Warning("FetchUrl fail: " + err.Error())
+		SetItemError(response, err)
+		// fetches stopped because every caller gave up or the budget ran
+		// out are not cached
+		if store && ctx.Err() == nil {
+			// errors for URLs refused by the policy hold until it changes
+			if _, blocked := err.(*PolicyError); blocked {
+				if cacheErr := cache.Set(POLICY_KEY_PREFIX+hash, cfg.Policy.Version, ErrorTTL(err)); cacheErr != nil {
+					logCacheError("Error saving policy version in cache", cacheErr)
+				}
+			}
+			cacheErr := SetResult(hash, response.String(), ErrorTTL(err))
+			if cacheErr != nil {
+				logCacheError("Error saving response in cache", cacheErr)
+			}
+			stored = cacheErr == nil
+		}
+	} else {
+		if opts.HeadOnly {
+			response.AddValue("headOnly", true)
+		}
+		if store {
+			err = SetResult(hash, response.String(), cfg.RedisTTL)
+			if err != nil {
+				logCacheError("Error saving response in cache", err)
+			}
+			stored = err == nil
+		}
+	}
+	return response.String(), stored
+}
+
+// FetchItem fetches a requested URL into response, which is held by
+// responseJson, and adds its redirect chain and fetch attempts.
+func FetchItem(ctx context.Context, reqStr string, u *url.URL, rootUrl string, chain *RedirectChain, responseJson *rj.Doc, response *rj.Container) error {
+	var err error
+	// hold a global fetch slot so concurrent batches share one limit
+	select {
+	case fetchSlots <- struct{}{}:
+		err = FetchUrl(ctx, reqStr, u, rootUrl, 0, chain, response)
+		<-fetchSlots
+	case <-ctx.Done():
+		err = FetchContextError(ctx)
+	}
+	chain.AddTo(responseJson, response)
+	return err
+}
+
+// FetchUrl fetches u and adds the parsed link to response, following
+// redirects. Network I/O and parsing stop as soon as ctx is done.
+func FetchUrl(ctx context.Context, req string, u *url.URL, rootUrl string, redirectCount int, chain *RedirectChain, response *rj.Container) error {
 	start := time.Now()
+	if ctx.Err() != nil {
+		return FetchContextError(ctx)
+	}
 
-	// check blacklist
-	if IsBlacklisted(rootUrl) {
-		return errors.New("Invalid URL (blacklisted)")
+	// check robots.txt
+	if cfg.Robots.Enabled {
+		if err := CheckRobots(ctx, u); err != nil {
+			return err
+		}
 	}
 
-	result, err := httpClient.Get(u.String())
+	getReq, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, connTrace), "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	getReq.Header.Set("Accept-Encoding", ACCEPT_ENCODING)
+
+	// retry transient failures while the deadline allows; the host slot and
+	// the connection are released before following a redirect so that
+	// same-host redirects neither wait on themselves nor need a new connection
+	var result *http.Response
+	var releaseHost func()
+	for attempt := 1; ; attempt++ {
+		chain.Attempted()
+		result, releaseHost, err = FetchAttempt(ctx, getReq)
+		delay, reason := cfg.Retry.Backoff(attempt, result, err)
+		if reason == "" || !WaitRetry(ctx, delay) {
+			break
+		}
+		fetchRetriesCounterVector.WithLabelValues(reason).Inc()
+		if result != nil {
+			DiscardBody(result.Body)
+		}
+		releaseHost()
+	}
+	defer releaseHost()
 	if result != nil {
-		defer result.Body.Close()
+		defer DiscardBody(result.Body)
+		chain.Fetched(u.String(), result.StatusCode, start)
 	}
 	if err != nil {
 		if urlError, ok := err.(*url.Error); ok && urlError.Err == RedirectAttempted {
@@ -172,29 +431,12 @@ func FetchUrl(req string, u *url.URL, rootUrl string, redirectCount int, respons
 				incUnsuccessfulCounter()
 				return err
 			}
-			redirect := CheckRedirectURL(nextU.String())
-			nextU, err = url.Parse(redirect)
-			if err != nil {
-				logger.Error("url Parse error: " + redirect)
-				incUnsuccessfulCounter()
-				return err
-			}
-			if nextU.Scheme == "" {
-				nextU.Scheme = u.Scheme
-			}
-			if nextU.Host == "" {
-				nextU.Host = u.Host
-			}
-			rootUrl = nextU.Host + nextU.Path
-			if nextU.RawQuery != "" {
-				rootUrl = rootUrl + "?" + nextU.RawQuery
-			}
-
-			if redirectCount >= cfg.MaxRedirect {
-				return errors.New("Max redirects limit reached! Request URL: " + req)
-			} else {
-				return FetchUrl(req, nextU, rootUrl, redirectCount+1, response)
-			}
+			releaseHost()
+			DiscardBody(result.Body)
+			chain.Redirected(REDIRECT_HTTP, start)
+			return FollowRedirect(ctx, req, u, nextU.String(), redirectCount, chain, response)
+		} else if errors.Is(err, AddressBlocked) {
+			return AddressBlocked
 		} else {
 			return err
 		}
@@ -202,48 +444,30 @@ func FetchUrl(req string, u *url.URL, rootUrl string, redirectCount int, respons
 
 	// check result status code
 	if result.StatusCode != 200 {
-		return errors.New("HTTP GET result status code: " + strconv.Itoa(result.StatusCode) + " url: " + u.String())
+		return &FetchError{
+			Code:   ERROR_HTTP_STATUS,
+			Status: result.StatusCode,
+			Msg:    "HTTP GET result status code: " + strconv.Itoa(result.StatusCode) + " url: " + u.String(),
+		}
 	} else {
 		link, hasLink := result.Header["Link"]
 		if hasLink {
 			if redirect := HeaderLinkRedirect(link); redirect != "" {
-				if redirectCount >= cfg.MaxRedirect {
-					return errors.New("Max redirects limit reached! Request URL: " + req)
-				} else {
-					nextU, err := url.Parse(redirect)
-					if err != nil {
-						logger.Error("url Parse error: " + redirect)
-						incUnsuccessfulCounter()
-						return err
-					}
-					if nextU.Scheme == "" {
-						nextU.Scheme = u.Scheme
-					}
-					if nextU.Host == "" {
-						nextU.Host = u.Host
-					}
-					rootUrl = nextU.Host + nextU.Path
-					if nextU.RawQuery != "" {
-						rootUrl = rootUrl + "?" + nextU.RawQuery
-					}
-					return FetchUrl(req, nextU, rootUrl, redirectCount+1, response)
-				}
+				releaseHost()
+				DiscardBody(result.Body)
+				chain.Redirected(REDIRECT_LINK_HEADER, start)
+				return FollowRedirect(ctx, req, u, redirect, redirectCount, chain, response)
 			}
 		}
 	}
 
-	// check result length
-	if result.ContentLength > CONTENT_LENGTH_LIMIT_BYTES {
-		return errors.New("File at URL is too large")
-	}
-
 	// check for text result
 	contentType, hasType := result.Header["Content-Type"]
 	if hasType {
 		contentType := strings.Join(contentType, " ")
 		contentType = strings.ToLower(contentType)
 		if !strings.Contains(contentType, "text") {
-			return errors.New("Invalid content-type detected: " + contentType)
+			return &FetchError{Code: ERROR_UNSUPPORTED_CONTENT_TYPE, Msg: "Invalid content-type detected: " + contentType}
 		}
 	}
 
@@ -255,52 +479,57 @@ func FetchUrl(req string, u *url.URL, rootUrl string, redirectCount int, respons
 	response.AddValue("url", u.String())
 	response.AddValue("providerUrl", "http://"+u.Host)
 
-	// check result encoding
-	var resultReader io.ReadCloser
-	switch result.Header.Get("Content-Encoding") {
-	case "gzip":
-		resultReader, err = gzip.NewReader(result.Body)
-		defer resultReader.Close()
-		if err != nil {
-			logger.Error("gzip error: " + err.Error())
-			return errors.New("gzip error: " + err.Error())
-		}
-	default:
-		resultReader = result.Body
+	// check result encoding; both the raw and the decoded body are capped so
+	// that neither a huge stream nor a compression bomb is read to the end
+	rawReader := NewCappedReader(result.Body, cfg.MaxCompressedBytes)
+	decoder, err := NewDecodingReader(rawReader, result.Header.Get("Content-Encoding"))
+	if err != nil {
+		logger.Warning(err.Error() + " url: " + u.String())
+		return err
 	}
+	defer decoder.Close()
+	bodyReader := NewCappedReader(decoder, cfg.MaxBodyBytes)
 
 	// parse response
-	utf8Reader, err := charset.NewReader(resultReader, "")
+	utf8Reader, err := charset.NewReader(bodyReader, "")
 	if err != nil {
 		return err
 	}
 	body := html.NewTokenizer(utf8Reader)
 
+	fetchStart := start
 	start = time.Now()
 	tags := make(map[string]string)
-	jsRedirect := ParseBody(body, tags, u.Host)
+	jsRedirect, headEnded := ParseBody(body, tags, u.Host, HeadOnly(ctx))
+	if ctx.Err() != nil {
+		// the body was cut off, do not return a partial result
+		return FetchContextError(ctx)
+	}
 	if jsRedirect != "" {
-		nextUrl := strings.Replace(jsRedirect, "\\", "", -1)
-		nextU, err := url.Parse(nextUrl)
-		if err != nil {
-			logger.Error("url Parse error: " + req)
-			incUnsuccessfulCounter()
-			return err
-		}
-		if nextU.Scheme == "" {
-			nextU.Scheme = u.Scheme
-		}
-		if nextU.Host == "" {
-			nextU.Host = u.Host
+		releaseHost()
+		DiscardBody(result.Body)
+		chain.Redirected(REDIRECT_SCRIPT, fetchStart)
+		return FollowRedirect(ctx, req, u, strings.Replace(jsRedirect, "\\", "", -1), redirectCount, chain, response)
+	}
+	if refresh, hasRefresh := tags["http-equiv:refresh"]; hasRefresh && cfg.FollowMetaRefresh {
+		if redirect := MetaRefreshURL(refresh, cfg.MetaRefreshMaxDelay); redirect != "" {
+			// a refresh to the page itself is a reload, not a redirect
+			if nextU, err := u.Parse(redirect); err == nil && nextU.String() != u.String() {
+				releaseHost()
+				DiscardBody(result.Body)
+				chain.Redirected(REDIRECT_META_REFRESH, fetchStart)
+				return FollowRedirect(ctx, req, u, redirect, redirectCount, chain, response)
+			}
 		}
-		rootUrl = nextU.Host + nextU.Path
-
-		if redirectCount >= cfg.MaxRedirect {
-			return errors.New("Max redirects limit reached! Request URL: " + req)
-		} else {
-			return FetchUrl(req, nextU, rootUrl, redirectCount+1, response)
+	}
+	if rawReader.Truncated() || bodyReader.Truncated() {
+		// without the whole <head> the metadata cannot be trusted
+		if !headEnded {
+			return &FetchError{Code: ERROR_TOO_LARGE, Msg: "File at URL is too large"}
 		}
+		response.AddValue("truncated", true)
 	}
+	AddCacheInfo(response, u, result.Header)
 
 	// check canonical URL
 	canonical, hasCanonical := tags["canonical"]
@@ -408,38 +637,108 @@ func FetchUrl(req string, u *url.URL, rootUrl string, redirectCount int, respons
 	return nil
 }
 
-// HTML parsing based on html.Tokenizer
-func ParseBody(body *html.Tokenizer, tags map[string]string, host string) string {
+// FetchAttempt makes a single request within the host's rate limit and
+// circuit breaker. The returned function releases the host slot; it is never
+// nil.
+func FetchAttempt(ctx context.Context, getReq *http.Request) (*http.Response, func(), error) {
+	host := getReq.URL.Hostname()
+	releaseHost, err := AcquireHost(ctx, host)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	// fail fast while the host's circuit is open
+	if err := BreakerAllow(host); err != nil {
+		return nil, releaseHost, err
+	}
+	result, err := httpClient.Do(getReq)
+	if ctx.Err() != nil {
+		// running out of time says nothing about the host
+		BreakerAbort(host)
+		if result != nil {
+			result.Body.Close()
+		}
+		return nil, releaseHost, FetchContextError(ctx)
+	}
+	BreakerRecord(host, result, err)
+	return result, releaseHost, err
+}
+
+// headOnlyKey is the context key marking fetches that only parse <head>.
+type headOnlyKey struct{}
+
+// WithHeadOnly returns a copy of ctx for fetches that only parse the head of
+// pages.
+func WithHeadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, headOnlyKey{}, true)
+}
+
+// HeadOnly reports whether fetches with ctx only parse the head of pages.
+func HeadOnly(ctx context.Context) bool {
+	headOnly, _ := ctx.Value(headOnlyKey{}).(bool)
+	return headOnly
+}
+
+// HTML parsing based on html.Tokenizer. Returns the target of a javascript
+// redirect if the page is a redirect interstitial, and whether the end of
+// <head> was reached. With headOnly set parsing stops at the end of <head>,
+// or once the body has too much text to be an interstitial when javascript
+// redirects are detected for host.
+func ParseBody(body *html.Tokenizer, tags map[string]string, host string, headOnly bool) (string, bool) {
 	iconSet := false
+	detectJS := cfg.JSRedirects.AppliesTo(host)
+	jsRedirect, textLen := "", 0
+	inBody := false
 	for body != nil {
 		tt := body.Next()
 		switch tt {
 		case html.ErrorToken:
 			// end of body
-			return ""
+			return jsRedirect, inBody
+		case html.TextToken:
+			if !inBody || !detectJS {
+				continue
+			}
+			// pages with real content are not redirect interstitials
+			textLen += len(strings.TrimSpace(string(body.Text())))
+			if textLen > cfg.JSRedirects.MaxPageTextChars {
+				detectJS, jsRedirect = false, ""
+				if headOnly {
+					return "", true
+				}
+			}
+		case html.EndTagToken:
+			if name, _ := body.TagName(); string(name) == "head" {
+				inBody = true
+				if headOnly && !detectJS {
+					return "", true
+				}
+			}
 		case html.SelfClosingTagToken:
 			fallthrough
 		case html.StartTagToken:
 			t := body.Token()
+			if t.Data == "body" {
+				inBody = true
+				if headOnly && !detectJS {
+					return "", true
+				}
+			}
 
 			switch t.Data {
-			// specific js handling
+			// look for js redirects in small inline scripts
 			case "script":
-				if host == "thr.cm" {
+				if tt == html.SelfClosingTagToken || body.Next() != html.TextToken {
+					continue
+				}
+				js := body.Text()
+				if detectJS && jsRedirect == "" && len(js) <= cfg.JSRedirects.MaxScriptBytes {
+					jsRedirect = FindJSRedirect(string(js))
+				}
+			// style contents are not page text
+			case "style":
+				if tt == html.StartTagToken {
 					body.Next()
-					js := string(body.Text())
-
-					i := strings.Index(js, "window.location.replace")
-					if i == -1 {
-						continue
-					}
-					i = i + 25
-					redirect := js[i:]
-					i = strings.Index(redirect, "'")
-					if i == -1 {
-						continue
-					}
-					return redirect[:i]
 				}
 			// look for title, description, OG values in meta tags
 			case "meta":
@@ -450,6 +749,8 @@ func ParseBody(body *html.Tokenizer, tags map[string]string, host string) string
 						tag = strings.ToLower(attr.Val)
 					} else if key == "property" {
 						tag = strings.ToLower(attr.Val)
+					} else if key == "http-equiv" && strings.ToLower(attr.Val) == "refresh" {
+						tag = "http-equiv:refresh"
 					} else if key == "content" {
 						content = html.UnescapeString(attr.Val)
 					}
@@ -488,26 +789,68 @@ func ParseBody(body *html.Tokenizer, tags map[string]string, host string) string
 			}
 		}
 	}
-	return ""
+	return "", inBody
 }
 
-func IsBlacklisted(rootUrl string) bool {
-	for _, a := range cfg.Blacklist {
-		if strings.Contains(rootUrl, a) {
-			return true
-		}
+// FetchContextError returns the item error for a fetch stopped because ctx
+// is done.
+func FetchContextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return DeadlineExceeded
+	}
+	return FetchCancelled
+}
+
+// FollowRedirect fetches location, resolved against the current URL u, as
+// the next hop of the redirect chain. Every hop is checked against the
+// policy before it is fetched.
+func FollowRedirect(ctx context.Context, req string, u *url.URL, location string, redirectCount int, chain *RedirectChain, response *rj.Container) error {
+	redirect := chain.Unwrap(location)
+	nextU, err := url.Parse(redirect)
+	if err != nil {
+		logger.Error("url Parse error: " + redirect)
+		incUnsuccessfulCounter()
+		return err
+	}
+	nextU = u.ResolveReference(nextU)
+	if err := cfg.Policy.Check(nextU); err != nil {
+		return err
+	}
+	rootUrl := nextU.Host + nextU.Path
+	if nextU.RawQuery != "" {
+		rootUrl = rootUrl + "?" + nextU.RawQuery
+	}
+
+	if redirectCount >= cfg.MaxRedirect {
+		return &FetchError{Code: ERROR_TOO_MANY_REDIRECTS, Msg: "Max redirects limit reached! Request URL: " + req}
 	}
-	return false
+	return FetchUrl(ctx, req, nextU, rootUrl, redirectCount+1, chain, response)
 }
 
+// CheckRedirectURL unwraps shortener and redirect wrapper URLs using the
+// unwrap rules, repeatedly for wrappers nested inside each other.
 func CheckRedirectURL(u string) string {
-	//u = strings.ToLower(u)
-	for _, re := range redirects {
-		if redirect := re.FindStringSubmatch(u); redirect != nil {
-			return redirect[1]
+	target, _ := UnwrapURL(u)
+	return target
+}
+
+// UnwrapURL returns the target of u after removing up to UNWRAP_MAX_DEPTH
+// nested wrappers, along with the wrapper URLs that were removed.
+func UnwrapURL(u string) (string, []string) {
+	unwrapLock.RLock()
+	rules := unwrapRules
+	unwrapLock.RUnlock()
+
+	var wrappers []string
+	for i := 0; i < UNWRAP_MAX_DEPTH; i++ {
+		target := rules.Unwrap(u)
+		if target == "" {
+			break
 		}
+		wrappers = append(wrappers, u)
+		u = target
 	}
-	return u
+	return u, wrappers
 }
 
 func HeaderLinkRedirect(link []string) string {
@@ -522,6 +865,28 @@ func HeaderLinkRedirect(link []string) string {
 	}
 }
 
+// MetaRefreshURL returns the target of a meta refresh content value such as
+// "0; url=http://example.com/", or "" if there is none or its delay is longer
+// than maxDelay.
+func MetaRefreshURL(content string, maxDelay time.Duration) string {
+	i := strings.IndexAny(content, ";,")
+	if i == -1 {
+		return ""
+	}
+	delay, err := strconv.ParseFloat(strings.TrimSpace(content[:i]), 64)
+	if err != nil || delay < 0 || time.Duration(delay*float64(time.Second)) > maxDelay {
+		return ""
+	}
+
+	target := strings.TrimSpace(content[i+1:])
+	if len(target) > 3 && strings.EqualFold(target[:3], "url") {
+		if rest := strings.TrimSpace(target[3:]); strings.HasPrefix(rest, "=") {
+			target = strings.TrimSpace(rest[1:])
+		}
+	}
+	return strings.Trim(target, `'"`)
+}
+
 // trim descriptions
 func TrimDescription(desc string) string {
 	result := strings.TrimSpace(desc)
@@ -9,12 +9,14 @@ import (
 	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/publicsuffix"
-	"gopkg.in/redis.v3"
 
 	irukaConfig "github.com/bottlenose-inc/go-common-tools/config" // go-common-tools config loader
 	irukaLogger "github.com/bottlenose-inc/go-common-tools/logger" // go-common-tools bunyan-style logger package
@@ -29,17 +31,28 @@ const (
 	BODY_LIMIT_BYTES = 1024 * 1024 // trunc incoming request to 1 MB
 	OBJECTS_PER_LOG  = 1000
 
+	DEFAULT_MAX_BODY_BYTES = 1024 * 512 // 512 KB
+
 	USAGE_STRING = `{
   "result": {
     "name": "links",
     "description": "Fetches resources identified by URLs",
     "in": {
-      "url": {"type": "string"}
+      "url": {"type": "string"},
+      "deadlineMs": {"type": "number"},
+      "headOnly": {"type": "boolean"},
+      "maxAge": {"type": "number"},
+      "noCache": {"type": "boolean"},
+      "noStore": {"type": "boolean"},
+      "onlyIfCached": {"type": "boolean"}
     },
     "out": {
       "link": {
         "type": "object",
         "fields": {
+          "attempts": {
+            "type": "number"
+          },
           "cacheHit": {
             "type": "boolean"
           },
@@ -49,18 +62,36 @@ const (
           "error": {
             "type": "string"
           },
+          "errorCode": {
+            "type": "string"
+          },
+          "etag": {
+            "type": "string"
+          },
           "fetchDuration": {
             "type": "number"
           },
+          "fetchedAt": {
+            "type": "number"
+          },
           "favicon": {
             "type" : "string"
           },
+          "headOnly": {
+            "type": "boolean"
+          },
           "id": {
             "type": "string"
           },
           "imageUrl": {
             "type": "string"
           },
+          "lastModified": {
+            "type": "string"
+          },
+          "maxAge": {
+            "type": "number"
+          },
           "originalUrl": {
             "type": "string"
           },
@@ -76,17 +107,44 @@ const (
           "providerUrl": {
             "type": "string"
           },
+          "redirectChain": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "fields": {
+                "url": {"type": "string"},
+                "status": {"type": "number"},
+                "mechanism": {"type": "string"},
+                "durationMs": {"type": "number"}
+              }
+            }
+          },
+          "stale": {
+            "type": "boolean"
+          },
           "title": {
             "type": "string"
           },
+          "truncated": {
+            "type": "boolean"
+          },
           "type": {
             "type": "string"
           },
           "url": {
             "type": "string"
           },
+          "validatorUrl": {
+            "type": "string"
+          },
+          "retryable": {
+            "type": "boolean"
+          },
           "rootUrl": {
             "type": "string"
+          },
+          "upstreamStatus": {
+            "type": "number"
           }
         }
       }
@@ -96,13 +154,18 @@ const (
 )
 
 var (
-	numProcessed = 0
-	startTime    = time.Now()
+	numProcessed  = 0
+	startTime     = time.Now()
+	processedLock sync.Mutex
 
-	redisClient *redis.Client
+	fetchSlots chan struct{} // global bound on in-flight fetches
 
 	httpClient        http.Client
+	cookies           = &resettableJar{}
 	RedirectAttempted = errors.New("redirect")
+	AddressBlocked    = errors.New("Invalid URL (private address)")
+	DeadlineExceeded  = errors.New("Fetch deadline exceeded")
+	FetchCancelled    = errors.New("Fetch cancelled")
 
 	totalRequestsCounter       prometheus.Counter
 	invalidRequestsCounter     prometheus.Counter
@@ -111,6 +174,16 @@ var (
 	requestDuration            prometheus.Histogram
 	errorsCounter              prometheus.Counter
 	cacheHitCounterVector      *prometheus.CounterVec
+	breakerStateGauge          *prometheus.GaugeVec
+	cacheAvailableGauge        prometheus.Gauge
+	connReuseCounterVector     *prometheus.CounterVec
+	fetchRetriesCounterVector  *prometheus.CounterVec
+	revalidationsCounterVector *prometheus.CounterVec
+	staleRefreshCounterVector  *prometheus.CounterVec
+	fetchesDedupCounterVector  *prometheus.CounterVec
+	itemErrorsCounterVector    *prometheus.CounterVec
+	adminRequestsCounterVector *prometheus.CounterVec
+	breakerTripsCounter        prometheus.Counter
 
 	notFound []byte
 	usage    []byte
@@ -147,48 +220,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	// reload unwrap rules when they change
+	if cfg.UnwrapReloadSec > 0 {
+		go WatchUnwrapRules(cfg.UnwrapRulesFile, time.Duration(cfg.UnwrapReloadSec)*time.Second)
+	}
+
 	// Start Prometheus metrics server
 	go metrics.StartPrometheusMetricsServer(SERVICE_NAME, logger, cfg.PrometheusPort)
 
 	// Initialize Prometheus Metrics
 	InitMetrics()
 
-	// init redis
-	logFile, err := os.OpenFile("log/redis-client.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		logger.Error("Error creating Redis client logfile: " + err.Error())
-	} else {
-		redis.Logger = log.New(logFile, "", log.LstdFlags)
-	}
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     cfg.RedisHost,
-		Password: "",
-		DB:       int64(cfg.RedisDB),
-	})
+	// init cache
+	cache = NewCache()
 
 	// init http client
-	options := cookiejar.Options{
-		PublicSuffixList: publicsuffix.List,
-	}
-	jar, err := cookiejar.New(&options)
-	if err != nil {
-		logger.Error("Error init cookie jar: " + err.Error())
-	}
-	httpClient = http.Client{
-		Timeout: cfg.HTTPGetTimeout,
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout: cfg.HTTPGetTimeout,
-			}).Dial,
-			TLSHandshakeTimeout: cfg.HTTPGetTimeout,
-			DisableCompression:  true,
-			DisableKeepAlives:   true,
-		},
-		Jar: jar,
-	}
-	httpClient.CheckRedirect = func(req *http.Request, iva []*http.Request) error {
-		return RedirectAttempted
-	}
+	ClearCookies()
+	httpClient = NewHTTPClient()
 
 	// Prepare responses
 	GenerateResponses()
@@ -207,7 +255,79 @@ func InitCfg() error {
 	}
 	cfg.RedisTTL = time.Duration(cfg.RedisTTLDays*24) * time.Hour
 	cfg.RedisErrorTTL = time.Duration(cfg.RedisErrorTTLMins) * time.Minute
+	errorTTLs, err := InitErrorTTLs(cfg.ErrorTTLMins)
+	if err != nil {
+		return err
+	}
+	cfg.ErrorTTLs = errorTTLs
+	if err := cfg.Redis.Init(cfg.RedisHost); err != nil {
+		return err
+	}
+	if err := cfg.Cache.Init(); err != nil {
+		return err
+	}
+	cfg.Stale.Init()
+	cfg.Admin.Init()
+	cfg.Coalesce.Poll = time.Duration(cfg.Coalesce.PollMs) * time.Millisecond
+	if cfg.Coalesce.Poll <= 0 {
+		cfg.Coalesce.Poll = 100 * time.Millisecond
+	}
+	cfg.CacheControl.Init()
 	cfg.HTTPGetTimeout = time.Duration(cfg.HTTPGetTimeoutSec) * time.Second
+	cfg.FetchBudget = time.Duration(cfg.FetchBudgetSec) * time.Second
+	cfg.Transport.IdleConnTimeout = time.Duration(cfg.Transport.IdleConnTimeoutSec) * time.Second
+	if cfg.FetchBudget <= 0 {
+		cfg.FetchBudget = cfg.HTTPGetTimeout * time.Duration(cfg.MaxRedirect+1)
+	}
+	cfg.MetaRefreshMaxDelay = time.Duration(cfg.MetaRefreshMaxSec) * time.Second
+	cfg.Robots.CacheTTL = time.Duration(cfg.Robots.CacheTTLHours) * time.Hour
+	cfg.Robots.MaxCrawlWait = time.Duration(cfg.Robots.MaxCrawlWaitSec) * time.Second
+
+	if cfg.MaxCompressedBytes <= 0 {
+		cfg.MaxCompressedBytes = DEFAULT_MAX_BODY_BYTES
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = DEFAULT_MAX_BODY_BYTES
+	}
+
+	if cfg.BatchConcurrency <= 0 {
+		cfg.BatchConcurrency = 1
+	}
+	if cfg.MaxConcurrentFetches <= 0 {
+		cfg.MaxConcurrentFetches = cfg.BatchConcurrency
+	}
+	fetchSlots = make(chan struct{}, cfg.MaxConcurrentFetches)
+
+	cfg.AllowedNets = nil
+	for _, cidr := range cfg.AllowedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		cfg.AllowedNets = append(cfg.AllowedNets, ipNet)
+	}
+
+	cfg.Policy.AddBlacklist(cfg.Blacklist)
+	if err := cfg.Policy.Compile(); err != nil {
+		return err
+	}
+	if err := cfg.HostLimits.Init(); err != nil {
+		return err
+	}
+	if err := cfg.Retry.Init(); err != nil {
+		return err
+	}
+	cfg.Breaker.OpenDuration = time.Duration(cfg.Breaker.OpenSec) * time.Second
+
+	for i, host := range cfg.JSRedirects.Hosts {
+		cfg.JSRedirects.Hosts[i] = strings.ToLower(host)
+	}
+
+	rules, err := LoadUnwrapRules(cfg.UnwrapRulesFile)
+	if err != nil {
+		return err
+	}
+	SetUnwrapRules(rules)
 
 	cfg.MultiTagsMap = make(map[string]bool)
 	for _, tag := range cfg.MultiTags {
@@ -226,6 +346,70 @@ func InitMetrics() {
 	errorsCounter, _ = metrics.CreateCounter("augmentation_errors_logged_total", "", "", "The total number of errors logged.", emptyMap)
 	objsProcessedCounterVector, _ = metrics.CreateCounterVector("augmentation_objects_processed_total", "", "", "The total number of objects processed.", emptyMap, []string{"status"})
 	cacheHitCounterVector, _ = metrics.CreateCounterVector("augmentation_objects_cache_hits", "", "", "Number of requests hitting redis cache.", emptyMap, []string{"cache"})
+	itemErrorsCounterVector, _ = metrics.CreateCounterVector("augmentation_item_errors_total", "", "", "Number of failed items, by error code.", emptyMap, []string{"code"})
+	breakerTripsCounter, _ = metrics.CreateCounter("augmentation_circuit_breaker_trips_total", "", "", "The total number of times a host circuit breaker opened.", emptyMap)
+	revalidationsCounterVector, _ = metrics.CreateCounterVector("augmentation_cache_revalidations_total", "", "", "Number of conditional GETs for stale results, by whether the result was modified.", emptyMap, []string{"result"})
+	staleRefreshCounterVector, _ = metrics.CreateCounterVector("augmentation_stale_refreshes_total", "", "", "Number of background refreshes of stale results, by outcome.", emptyMap, []string{"result"})
+	fetchesDedupCounterVector, _ = metrics.CreateCounterVector("augmentation_fetches_deduplicated_total", "", "", "Number of requests that shared another request's fetch, by whether it ran in this process or another instance.", emptyMap, []string{"scope"})
+	adminRequestsCounterVector, _ = metrics.CreateCounterVector("augmentation_admin_requests_total", "", "", "Number of cache administration requests, by action and response status.", emptyMap, []string{"action", "status"})
+	connReuseCounterVector, _ = metrics.CreateCounterVector("augmentation_http_connections_total", "", "", "Number of connections used for fetches, by whether they were reused from the pool.", emptyMap, []string{"reused"})
+	fetchRetriesCounterVector, _ = metrics.CreateCounterVector("augmentation_fetch_retries_total", "", "", "Number of fetch retries, by status code or error class.", emptyMap, []string{"reason"})
+
+	// go-common-tools has no gauge helper, register directly with the default registry
+	breakerStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "augmentation_circuit_breaker_hosts",
+		Help: "Number of hosts with recent failures, by circuit breaker state.",
+	}, []string{"state"})
+	if err := prometheus.Register(breakerStateGauge); err != nil {
+		logger.Error("Error registering circuit breaker gauge: " + err.Error())
+	}
+	cacheAvailableGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "augmentation_cache_available",
+		Help: "Whether the cache can be reached (1) or links are fetched uncached (0).",
+	})
+	cacheAvailableGauge.Set(1)
+	if err := prometheus.Register(cacheAvailableGauge); err != nil {
+		logger.Error("Error registering cache availability gauge: " + err.Error())
+	}
+}
+
+// NewHTTPClient creates the client used to fetch links. Redirects are not
+// followed by the client so that FetchUrl can check each hop, and the dialer
+// refuses to connect to private and reserved addresses.
+func NewHTTPClient() http.Client {
+	client := http.Client{
+		Timeout:   cfg.HTTPGetTimeout,
+		Transport: NewTransport(),
+		Jar:       cookies,
+	}
+	client.CheckRedirect = func(req *http.Request, iva []*http.Request) error {
+		return RedirectAttempted
+	}
+	return client
+}
+
+// resettableJar is a cookie jar that can be swapped out while concurrent
+// fetches are using it.
+type resettableJar struct {
+	sync.RWMutex
+	jar http.CookieJar
+}
+
+func (j *resettableJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.RLock()
+	defer j.RUnlock()
+	if j.jar != nil {
+		j.jar.SetCookies(u, cookies)
+	}
+}
+
+func (j *resettableJar) Cookies(u *url.URL) []*http.Cookie {
+	j.RLock()
+	defer j.RUnlock()
+	if j.jar == nil {
+		return nil
+	}
+	return j.jar.Cookies(u)
 }
 
 // Clear cookies regularly
@@ -237,7 +421,9 @@ func ClearCookies() {
 	if err != nil {
 		logger.Error("Error init cookie jar: " + err.Error())
 	} else {
-		httpClient.Jar = jar
+		cookies.Lock()
+		cookies.jar = jar
+		cookies.Unlock()
 	}
 }
 
@@ -266,6 +452,8 @@ func getRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	router.NotFoundHandler = HandlerWrapper(NotFound)
 	router.Methods("GET").Path("/").Handler(HandlerWrapper(Usage))
+	router.Methods("GET").Path("/ready").HandlerFunc(Ready)
+	addAdminRoutes(router)
 	router.Methods("POST").Path("/").Handler(HandlerWrapper(Links))
 	return router
 }
@@ -313,6 +501,8 @@ func incCacheMissCounter() {
 // logProcessed logs throughput every numProcessed objects. Throughput is rounded for
 // slightly prettier output.
 func logProcessed() {
+	processedLock.Lock()
+	defer processedLock.Unlock()
 	numProcessed = numProcessed + 1
 	if numProcessed == OBJECTS_PER_LOG {
 		now := time.Since(startTime)
@@ -1,17 +1,31 @@
 package main
 
 import (
-	"crypto/md5"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"gopkg.in/redis.v3"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/redis/go-redis/v9"
 
 	irukaLogger "github.com/bottlenose-inc/go-common-tools/logger" // go-common-tools bunyan-style logger package
 	"github.com/bottlenose-inc/go-common-tools/metrics"            // go-common-tools Prometheus metrics package
@@ -41,18 +55,8 @@ func TestMain(m *testing.M) {
 	go metrics.StartPrometheusMetricsServer(SERVICE_NAME+"-test", logger, cfg.PrometheusPort)
 	InitMetrics()
 
-	// init redis
-	logFile, err := os.OpenFile("log/redis-client.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		logger.Error("Error creating Redis client logfile: " + err.Error())
-	} else {
-		redis.Logger = log.New(logFile, "", log.LstdFlags)
-	}
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     cfg.RedisHost,
-		Password: "",
-		DB:       int64(cfg.RedisDB),
-	})
+	// tests run against an in-process cache, without redis
+	cache = NewLRUCache(0, 0)
 
 	// Prepare responses
 	GenerateResponses()
@@ -151,7 +155,7 @@ func TestMissingUrlKey(t *testing.T) {
 	body, err := ioutil.ReadAll(resp.Body)
 	assert.Nil(t, err, "should not error reading response")
 	assert.Equal(t, 400, resp.StatusCode, "response status code should be 400")
-	expected := `{"response":[{"error":"Missing url key"}]}`
+	expected := `{"response":[{"error":"Missing url key","errorCode":"invalid_request","retryable":false}]}`
 	assert.Equal(t, []byte(expected), body, "not found response should match")
 }
 
@@ -170,16 +174,16 @@ func TestBlacklist(t *testing.T) {
 	body, err := ioutil.ReadAll(resp.Body)
 	assert.Nil(t, err, "should not error reading response")
 	assert.Equal(t, 203, resp.StatusCode, "response status code should be 204")
-	expected := `{"response":[{"error":"Invalid URL (blacklisted)"}]}`
+	expected := `{"response":[{"error":"Invalid URL (blacklisted)","errorCode":"blacklisted","retryable":false,"blockedBy":"domain=squidos.com"}]}`
 	assert.Equal(t, []byte(expected), body, "not found response should match")
 }
 
 func TestSuccessfulGoogle(t *testing.T) {
 	fmt.Println(">> Testing POST / (with proper request for www.google.com)...")
 
-	// remove redis records
-	hash := fmt.Sprintf("%x", md5.Sum([]byte("www.google.com")))
-	redisClient.Del(hash)
+	// remove cached records
+	hash := CacheHash("www.google.com")
+	DeleteResult(hash)
 
 	google, err := ioutil.ReadFile("test/google.out")
 
@@ -221,9 +225,9 @@ func TestSuccessfulGoogle(t *testing.T) {
 func TestSuccessfulTheRock(t *testing.T) {
 	fmt.Println(">> Testing POST / (with proper request for www.imdb.com/title/tt0117500/)...")
 
-	// remove redis records
-	hash := fmt.Sprintf("%x", md5.Sum([]byte("www.imdb.com/title/tt0117500/")))
-	redisClient.Del(hash)
+	// remove cached records
+	hash := CacheHash("www.imdb.com/title/tt0117500/")
+	DeleteResult(hash)
 
 	imdb, err := ioutil.ReadFile("test/imdb.out")
 
@@ -332,9 +336,9 @@ func TestBadImage(t *testing.T) {
 func TestRedirectToGoogle(t *testing.T) {
 	fmt.Println(">> Testing POST / (with redirecting url to www.google.com)...")
 
-	// remove redis records
-	hash := fmt.Sprintf("%x", md5.Sum([]byte("www.google.com")))
-	redisClient.Del(hash)
+	// remove cached records
+	hash := CacheHash("www.google.com")
+	DeleteResult(hash)
 
 	google, err := ioutil.ReadFile("test/google.out")
 
@@ -372,3 +376,1810 @@ func TestRedirectToGoogle(t *testing.T) {
 	ctStr, _ := contentType.GetString()
 	assert.Equal(t, "website", ctStr, "type should be website")
 }
+
+func TestBatchOrder(t *testing.T) {
+	fmt.Println(">> Testing POST / (batch responses keep request order)...")
+
+	// remove cached records
+	for _, rootUrl := range []string{"www.google.com/", "www.imdb.com/title/tt0117500/"} {
+		hash := CacheHash(rootUrl)
+		DeleteResult(hash)
+	}
+
+	google, err := ioutil.ReadFile("test/google.out")
+	imdb, err := ioutil.ReadFile("test/imdb.out")
+
+	mock := irukatest.InitMockHTTP()
+	mock.AddTestData("http://www.google.com/", 200, google)
+	mock.AddTestData("http://www.imdb.com/title/tt0117500/", 200, imdb)
+	defer mock.Close()
+	SetTestClient(mock.Client)
+
+	// prepare request
+	reader := strings.NewReader(`{"request": [{"url": "http://www.imdb.com/title/tt0117500/"}, {"bad_url": "x"}, {"url": "http://www.google.com/"}, {"url": "http://www.imdb.com/title/tt0117500/"}]}`)
+
+	// perform request
+	resp, err := http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+
+	// Read response
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	assert.Equal(t, 400, resp.StatusCode, "response status code should be 400")
+
+	responseJson, _ := rj.NewParsedJson(body)
+	defer responseJson.Free()
+	respCt := responseJson.GetContainer()
+	responses, _ := respCt.GetMember("response")
+	respArray, _, _ := responses.GetArray()
+	assert.Equal(t, 4, len(respArray), "should have one response per request")
+	expected := []string{"The Rock (1996)", "", "Google", "The Rock (1996)"}
+	for i, titleStr := range expected {
+		if titleStr == "" {
+			assert.True(t, respArray[i].HasMember("error"), "item without url should error")
+			continue
+		}
+		link, _ := respArray[i].GetMember("link")
+		title, _ := link.GetMember("title")
+		actual, _ := title.GetString()
+		assert.Equal(t, titleStr, actual, "titles should be in request order")
+	}
+}
+
+func TestPrivateAddress(t *testing.T) {
+	fmt.Println(">> Testing POST / (with url on a private address)...")
+
+	basic, err := ioutil.ReadFile("test/basic.out")
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	defer local.Close()
+	SetTestClient(NewHTTPClient())
+
+	// remove cached records
+	u, _ := url.Parse(local.URL + "/")
+	hash := CacheHash(u.Host + u.Path)
+	DeleteResult(hash)
+
+	// prepare request
+	reader := strings.NewReader(`{"request": [{"url": "` + local.URL + `/"}]}`)
+
+	// perform request
+	resp, err := http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+
+	// Read response
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	assert.Equal(t, 203, resp.StatusCode, "response status code should be 203")
+	expected := `{"response":[{"attempts":1,"error":"Invalid URL (private address)","errorCode":"private_address","retryable":false,"cacheHit":false}]}`
+	assert.Equal(t, []byte(expected), body, "private address response should match")
+
+	// allowlisted ranges can still be fetched
+	DeleteResult(hash)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg.AllowedNets = []*net.IPNet{loopback}
+	defer func() { cfg.AllowedNets = nil }()
+
+	reader = strings.NewReader(`{"request": [{"url": "` + local.URL + `/"}]}`)
+	resp, err = http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode, "response status code should be 200")
+}
+
+func TestPolicy(t *testing.T) {
+	fmt.Println(">> Testing domain policy rules...")
+
+	policy := Policy{Rules: []PolicyRule{
+		{Domain: "squidos.com"},
+		{Domain: "*.example.org"},
+		{Host: "www.example.net", PathPrefix: "/ads/"},
+		{Regex: `^[^/]*/share\?`},
+		{Domain: "Bücher.example."},
+	}}
+	assert.Nil(t, policy.Compile(), "policy should compile")
+
+	cases := map[string]string{
+		"http://squidos.com/":                 "domain=squidos.com",
+		"http://squidos.com./":                "domain=squidos.com",
+		"http://SquidOS.COM/":                 "domain=squidos.com",
+		"http://www.squidos.com/page":         "domain=squidos.com",
+		"http://WWW.squidos.com./page":        "domain=squidos.com",
+		"http://WWW.EXAMPLE.NET./ads/banner":  "host=www.example.net pathPrefix=/ads/",
+		"http://a.Example.Org./":              "domain=*.example.org",
+		"http://xn--bcher-kva.example/":       "domain=xn--bcher-kva.example",
+		"http://www.BÜCHER.example./":         "domain=xn--bcher-kva.example",
+		"http://notsquidos.com/page":          "",
+		"http://google.com/?q=squidos.com":    "",
+		"http://a.example.org/":               "domain=*.example.org",
+		"http://example.org/":                 "",
+		"http://www.example.net/ads/banner":   "host=www.example.net pathPrefix=/ads/",
+		"http://www.example.net/news/article": "",
+		"http://foo.com/share?u=1":            "regex=^[^/]*/share\\?",
+	}
+	for rawUrl, rule := range cases {
+		u, _ := url.Parse(rawUrl)
+		err := policy.Check(u)
+		if rule == "" {
+			assert.Nil(t, err, rawUrl+" should be allowed")
+		} else if assert.NotNil(t, err, rawUrl+" should be blocked") {
+			assert.Equal(t, rule, err.(*PolicyError).Rule, rawUrl+" should match rule")
+		}
+	}
+
+	// allowlist mode only fetches matching URLs
+	policy = Policy{Mode: "allowlist", Rules: []PolicyRule{
+		{Host: "private.example.com", Action: "deny"},
+		{Domain: "example.com"},
+	}}
+	assert.Nil(t, policy.Compile(), "policy should compile")
+	u, _ := url.Parse("http://www.example.com/")
+	assert.Nil(t, policy.Check(u), "allowlisted domain should be allowed")
+	u, _ = url.Parse("http://private.example.com/")
+	assert.NotNil(t, policy.Check(u), "denied host should be blocked")
+	u, _ = url.Parse("http://www.google.com/")
+	err := policy.Check(u)
+	if assert.NotNil(t, err, "unlisted domain should be blocked") {
+		assert.Equal(t, "allowlist", err.(*PolicyError).Rule, "unlisted domain should report allowlist")
+	}
+
+	// domains of the old blacklist setting are denied in either mode
+	policy = Policy{Mode: "allowlist", Rules: []PolicyRule{{Domain: "example.com"}}}
+	policy.AddBlacklist([]string{"squidos.com", "private.example.com"})
+	assert.Nil(t, policy.Compile(), "policy should compile")
+	u, _ = url.Parse("http://www.squidos.com./")
+	assert.NotNil(t, policy.Check(u), "blacklisted domain should be blocked")
+	u, _ = url.Parse("http://private.example.com/")
+	err = policy.Check(u)
+	if assert.NotNil(t, err, "blacklisted domain should be blocked before other rules") {
+		assert.Equal(t, "domain=private.example.com action=deny", err.(*PolicyError).Rule)
+	}
+	u, _ = url.Parse("http://www.example.com/")
+	assert.Nil(t, policy.Check(u), "allowlisted domain should be allowed")
+
+	// rules covering a whole public suffix are refused
+	policy = Policy{Rules: []PolicyRule{{Domain: "co.uk"}}}
+	assert.NotNil(t, policy.Compile(), "public suffix rule should not compile")
+}
+
+func TestTruncatedBody(t *testing.T) {
+	fmt.Println(">> Testing POST / (with body over the size limit)...")
+
+	// remove cached records
+	hash := CacheHash("www.google.com/")
+	DeleteResult(hash)
+	defer DeleteResult(hash)
+
+	google, err := ioutil.ReadFile("test/google.out")
+
+	mock := irukatest.InitMockHTTP()
+	mock.AddTestData("http://www.google.com/", 200, google)
+	defer mock.Close()
+	SetTestClient(mock.Client)
+
+	// cut off after </head>, which google.out ends at byte 4981
+	limit := cfg.MaxCompressedBytes
+	cfg.MaxCompressedBytes = 6144
+	defer func() { cfg.MaxCompressedBytes = limit }()
+
+	// prepare request
+	reader := strings.NewReader(`{"request": [{"url": "http://www.google.com/"}]}`)
+
+	// perform request
+	resp, err := http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+
+	// Read response
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	assert.Equal(t, 200, resp.StatusCode, "response status code should be 200")
+
+	responseJson, _ := rj.NewParsedJson(body)
+	defer responseJson.Free()
+	respCt := responseJson.GetContainer()
+	responses, _ := respCt.GetMember("response")
+	respArray, _, _ := responses.GetArray()
+	link, _ := respArray[0].GetMember("link")
+	title, _ := link.GetMember("title")
+	titleStr, _ := title.GetString()
+	assert.Equal(t, "Google", titleStr, "Title should be Google")
+	truncated, _ := link.GetMember("truncated")
+	truncatedBool, _ := truncated.GetBool()
+	assert.True(t, truncatedBool, "truncated should be set")
+
+	// a body cut off before the end of <head> cannot be used
+	DeleteResult(hash)
+	cfg.MaxCompressedBytes = 64
+	result := ProcessLink(context.Background(), "http://www.google.com/", CacheOptions{})
+	item := result.docs[0].GetContainer().String()
+	result.Free()
+	assert.Contains(t, item, `"errorCode":"too_large"`, "body cut off in <head> should fail the item")
+	assert.NotContains(t, item, `"title"`)
+
+	// a small gzip body expanding past the decoded cap is cut off there
+	bomb := func(head string, body string) []byte {
+		var b bytes.Buffer
+		gw := gzip.NewWriter(&b)
+		gw.Write([]byte("<html><head><title>Bomb</title>" + head + "</head><body>" + body + "</body></html>"))
+		gw.Close()
+		return b.Bytes()
+	}
+	padding := strings.Repeat("a", 1<<20)
+	pages := map[string][]byte{"/body": bomb("", padding), "/head": bomb("<!--"+padding+"-->", "")}
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(pages[r.URL.Path])
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+	assert.True(t, len(pages["/body"]) < 4096, "gzip body should be small")
+	maxBody := cfg.MaxBodyBytes
+	defer func() { cfg.MaxBodyBytes = maxBody }()
+	cfg.MaxCompressedBytes, cfg.MaxBodyBytes = limit, 64*1024
+
+	base := strings.Replace(local.URL, "127.0.0.1", "localhost", 1)
+	for _, path := range []string{"/body", "/head"} {
+		DeleteResult(CacheHash(strings.TrimPrefix(base, "http://") + path))
+		defer DeleteResult(CacheHash(strings.TrimPrefix(base, "http://") + path))
+	}
+	result = ProcessLink(context.Background(), base+"/body", CacheOptions{})
+	item = result.docs[0].GetContainer().String()
+	result.Free()
+	assert.Contains(t, item, `"title":"Bomb"`)
+	assert.Contains(t, item, `"truncated":true`, "decoded body over the cap should be truncated")
+	result = ProcessLink(context.Background(), base+"/head", CacheOptions{})
+	item = result.docs[0].GetContainer().String()
+	result.Free()
+	assert.Contains(t, item, `"errorCode":"too_large"`, "decoded cap hit in <head> should fail the item")
+}
+
+func TestHeadOnly(t *testing.T) {
+	fmt.Println(">> Testing POST / (parsing only the head of pages)...")
+
+	page := []byte(`<html><head><title>Head Title</title></head><body><meta property="og:description" content="Body Description"></body></html>`)
+	var fetches int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(page)
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+	// javascript redirect detection reads on into the body
+	jsRedirects := cfg.JSRedirects
+	defer func() { cfg.JSRedirects = jsRedirects }()
+	cfg.JSRedirects.Enabled = false
+
+	pageUrl := strings.Replace(local.URL, "127.0.0.1", "localhost", 1) + "/head"
+	u, _ := url.Parse(pageUrl)
+	hash := CacheHash(u.Host + u.Path)
+	DeleteResult(hash)
+	defer DeleteResult(hash)
+
+	// head only results miss fields found in the body, and are flagged
+	_, body := postLinks(t, `{"request": [{"url": "`+pageUrl+`", "headOnly": true}]}`)
+	assert.Contains(t, body, `"title":"Head Title"`)
+	assert.Contains(t, body, `"headOnly":true`)
+	assert.NotContains(t, body, "Body Description", "body should not be parsed")
+
+	// they are not served to requests wanting the whole page
+	_, body = postLinks(t, `{"request": [{"url": "`+pageUrl+`"}]}`)
+	assert.Contains(t, body, "Body Description", "whole page should be parsed")
+	assert.NotContains(t, body, `"headOnly"`)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches), "head only result should not be served")
+
+	// whole page results are served to head only requests
+	_, body = postLinks(t, `{"request": [{"url": "`+pageUrl+`"}], "headOnly": true}`)
+	assert.Contains(t, body, `"cacheHit":true`)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches), "whole page result should be served")
+
+	// head only fetches skipping the cache do not replace the whole page
+	_, body = postLinks(t, `{"request": [{"url": "`+pageUrl+`"}], "headOnly": true, "noCache": true}`)
+	assert.Contains(t, body, `"headOnly":true`)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches), "head only request should skip the cache")
+	cached, err := GetResult(hash)
+	assert.Nil(t, err)
+	assert.Contains(t, cached, "Body Description", "whole page result should be kept")
+	assert.NotContains(t, cached, `"headOnly"`)
+}
+
+func TestContentEncodings(t *testing.T) {
+	fmt.Println(">> Testing Content-Encoding decoders...")
+
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"br":      func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		},
+	}
+	encode := func(data []byte, encoding string) []byte {
+		var b bytes.Buffer
+		w := encoders[encoding](&b)
+		w.Write(data)
+		w.Close()
+		return b.Bytes()
+	}
+
+	for encoding := range encoders {
+		decoder, err := NewDecodingReader(bytes.NewReader(encode(basic, encoding)), encoding)
+		if assert.Nil(t, err, encoding+" should be supported") {
+			decoded, err := ioutil.ReadAll(decoder)
+			assert.Nil(t, err, encoding+" should decode")
+			assert.Equal(t, basic, decoded, encoding+" should round trip")
+			decoder.Close()
+		}
+	}
+
+	// raw deflate without the zlib wrapper
+	var raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	fw.Write(basic)
+	fw.Close()
+	decoder, err := NewDecodingReader(&raw, "deflate")
+	if assert.Nil(t, err, "raw deflate should be supported") {
+		decoded, _ := ioutil.ReadAll(decoder)
+		assert.Equal(t, basic, decoded, "raw deflate should round trip")
+	}
+
+	// encodings are undone in reverse order
+	chained := encode(encode(basic, "gzip"), "br")
+	decoder, err = NewDecodingReader(bytes.NewReader(chained), "gzip, br")
+	if assert.Nil(t, err, "chained encodings should be supported") {
+		decoded, _ := ioutil.ReadAll(decoder)
+		assert.Equal(t, basic, decoded, "chained encodings should round trip")
+	}
+
+	_, err = NewDecodingReader(bytes.NewReader(basic), "compress")
+	if assert.NotNil(t, err, "unknown encodings should error") {
+		assert.Equal(t, "Unsupported content-encoding: compress", err.Error())
+	}
+}
+
+func TestRobots(t *testing.T) {
+	fmt.Println(">> Testing robots.txt rules...")
+
+	robotsTxt := `# comment
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+
+User-agent: other-bot
+User-agent: links-parser
+Disallow: /nolinks/
+Crawl-delay: 1.5
+`
+	robots := ParseRobots(robotsTxt, "links-parser")
+	assert.Equal(t, 1500*time.Millisecond, robots.CrawlDelay, "crawl-delay should be parsed")
+	u, _ := url.Parse("http://example.com/nolinks/page")
+	assert.False(t, robots.Allowed(u), "agent group should apply")
+	u, _ = url.Parse("http://example.com/private")
+	assert.True(t, robots.Allowed(u), "only the agent group should apply")
+
+	robots = ParseRobots(robotsTxt, "unknown-bot")
+	cases := map[string]bool{
+		"http://example.com/":                    true,
+		"http://example.com/private/page":        false,
+		"http://example.com/private/public/page": true,
+		"http://example.com/files/doc.pdf":       false,
+		"http://example.com/files/doc.pdf?x=1":   true,
+	}
+	for rawUrl, allowed := range cases {
+		u, _ := url.Parse(rawUrl)
+		assert.Equal(t, allowed, robots.Allowed(u), rawUrl)
+	}
+
+	// disallowed URLs are not fetched
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	mock := irukatest.InitMockHTTP()
+	mock.AddTestData("http://robots.example.com/robots.txt", 200, []byte(robotsTxt))
+	mock.AddTestData("http://robots.example.com/nolinks/page", 200, basic)
+	defer mock.Close()
+	SetTestClient(mock.Client)
+
+	cache.Delete(ROBOTS_KEY_PREFIX + "http://robots.example.com")
+	DeleteResult(CacheHash("robots.example.com/nolinks/page"))
+	cfg.Robots.Enabled = true
+	defer func() { cfg.Robots.Enabled = false }()
+
+	reader := strings.NewReader(`{"request": [{"url": "http://robots.example.com/nolinks/page"}]}`)
+	resp, err := http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	assert.Equal(t, 203, resp.StatusCode, "response status code should be 203")
+	expected := `{"response":[{"error":"Disallowed by robots.txt","errorCode":"robots_disallowed","retryable":false,"cacheHit":false}]}`
+	assert.Equal(t, []byte(expected), body, "disallowed response should match")
+
+	// server errors for robots.txt disallow everything
+	mock.AddTestData("http://down.example.com/robots.txt", 503, nil)
+	cache.Delete(ROBOTS_KEY_PREFIX + "http://down.example.com")
+	u, _ = url.Parse("http://down.example.com/page")
+	err = CheckRobots(context.Background(), u)
+	assert.Equal(t, RobotsDisallowed, err, "unreachable robots.txt should disallow everything")
+	ttl, _ := cache.TTL(ROBOTS_KEY_PREFIX + "http://down.example.com")
+	assert.True(t, ttl <= cfg.RedisErrorTTL, "unreachable robots.txt should be cached for the error TTL")
+
+	// waiting for robots.txt stops at the client's deadline
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	SetTestClient(NewHTTPClient())
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg.AllowedNets = []*net.IPNet{loopback}
+	defer func() { cfg.AllowedNets = nil }()
+
+	u, _ = url.Parse(slow.URL + "/page")
+	cache.Delete(ROBOTS_KEY_PREFIX + "http://" + u.Host)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = GetRobots(ctx, u)
+	assert.Equal(t, DeadlineExceeded, err, "robots.txt wait should stop at the deadline")
+	assert.True(t, time.Since(start) < time.Second, "robots.txt wait should stop at the deadline")
+
+	// the shared fetch carries on without the client, and later callers join it
+	_, err = GetRobots(context.Background(), u)
+	assert.Nil(t, err, "robots.txt fetch should finish after the client gave up")
+
+	// redirects to URLs refused by the policy are not followed
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://blocked.example.com/robots.txt", http.StatusMovedPermanently)
+	}))
+	defer redirecting.Close()
+	policy := cfg.Policy
+	defer func() { cfg.Policy = policy }()
+	cfg.Policy = Policy{Rules: []PolicyRule{{Domain: "blocked.example.com", Action: POLICY_ACTION_DENY}}}
+	assert.Nil(t, cfg.Policy.Compile(), "policy should compile")
+	_, _, err = FetchRobots(context.Background(), redirecting.URL+"/robots.txt")
+	assert.Equal(t, RobotsUnavailable, err, "blocked redirect should not be followed")
+}
+
+func TestHostLimits(t *testing.T) {
+	fmt.Println(">> Testing per-host rate limits...")
+
+	limits := cfg.HostLimits
+	defer func() { cfg.HostLimits = limits }()
+	cfg.HostLimits = HostLimitsConfig{
+		OnLimit: "reject",
+		Overrides: []HostLimitOverride{
+			{Domain: "limited.example.com", RequestsPerSec: 1, Burst: 2, MaxConnections: 1},
+			{Domain: "queued.example.com", MaxConnections: 1},
+		},
+	}
+	assert.Nil(t, cfg.HostLimits.Init(), "host limits should init")
+
+	// subdomains share the overridden domain's connection slot
+	release, err := AcquireHost(context.Background(), "a.limited.example.com")
+	assert.Nil(t, err, "first fetch should not be limited")
+	_, err = AcquireHost(context.Background(), "b.limited.example.com")
+	assert.Equal(t, RateLimited, err, "second concurrent fetch should be rejected")
+	release()
+	release()
+
+	// the rejected fetch did not spend a request token
+	release, err = AcquireHost(context.Background(), "limited.example.com")
+	assert.Nil(t, err, "fetch within the burst should not be limited")
+	release()
+
+	// the burst of two is now used up
+	_, err = AcquireHost(context.Background(), "limited.example.com")
+	assert.Equal(t, RateLimited, err, "fetch beyond the burst should be rejected")
+
+	// queued fetches wait for a free slot
+	cfg.HostLimits.OnLimit = "queue"
+	cfg.HostLimits.MaxWait = time.Second
+	release, err = AcquireHost(context.Background(), "queued.example.com")
+	assert.Nil(t, err, "first fetch should not be limited")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release()
+	}()
+	release, err = AcquireHost(context.Background(), "queued.example.com")
+	assert.Nil(t, err, "queued fetch should get the released slot")
+
+	cfg.HostLimits.MaxWait = 10 * time.Millisecond
+	_, err = AcquireHost(context.Background(), "queued.example.com")
+	assert.Equal(t, RateLimited, err, "queued fetch should give up after the wait limit")
+
+	// without a wait limit queued fetches wait as long as their context allows
+	cfg.HostLimits.MaxWait = 0
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release, err = AcquireHost(ctx, "queued.example.com")
+	assert.Nil(t, err, "queued fetch should wait for the released slot")
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = AcquireHost(ctx, "queued.example.com")
+	assert.Equal(t, DeadlineExceeded, err, "queued fetch should give up at its deadline")
+	release()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	fmt.Println(">> Testing per-host circuit breaker...")
+
+	breaker := cfg.Breaker
+	defer func() { cfg.Breaker = breaker }()
+	cfg.Breaker = BreakerConfig{Enabled: true, FailureThreshold: 2, OpenDuration: 50 * time.Millisecond}
+
+	host := "breaker.example.com"
+	down := &http.Response{StatusCode: 503}
+	up := &http.Response{StatusCode: 200}
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, BreakerAllow(host), "closed circuit should allow fetches")
+		BreakerRecord(host, down, nil)
+	}
+	assert.Equal(t, CircuitOpen, BreakerAllow(host), "circuit should open after consecutive failures")
+
+	// after the open period a single probe is let through
+	time.Sleep(60 * time.Millisecond)
+	assert.Nil(t, BreakerAllow(host), "half-open circuit should allow a probe")
+	assert.Equal(t, CircuitOpen, BreakerAllow(host), "only one probe should be in flight")
+	BreakerRecord(host, down, nil)
+	assert.Equal(t, CircuitOpen, BreakerAllow(host), "failed probe should reopen the circuit")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Nil(t, BreakerAllow(host), "half-open circuit should allow a probe")
+	BreakerRecord(host, up, nil)
+	assert.Nil(t, BreakerAllow(host), "successful probe should close the circuit")
+	BreakerRecord(host, up, nil)
+}
+
+func TestMetaRefresh(t *testing.T) {
+	fmt.Println(">> Testing meta refresh redirect")
+
+	refresh, err := ioutil.ReadFile("test/metarefresh.out")
+	basic, err := ioutil.ReadFile("test/basic.out")
+
+	mock := irukatest.InitMockHTTP()
+	mock.AddTestData("http://refresh.example.com/go", 200, refresh)
+	mock.AddTestData("http://trib.al/QNAQUT9", 200, basic)
+	defer mock.Close()
+	SetTestClient(mock.Client)
+
+	// prepare request
+	reader := strings.NewReader(`{"request": [{"url": "http://refresh.example.com/go"}]}`)
+
+	// perform request
+	resp, err := http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+
+	// Read response
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	assert.Equal(t, 200, resp.StatusCode, "response status code should be 200")
+
+	responseJson, _ := rj.NewParsedJson(body)
+	defer responseJson.Free()
+	respCt := responseJson.GetContainer()
+	responses, _ := respCt.GetMember("response")
+	respArray, _, _ := responses.GetArray()
+	link, _ := respArray[0].GetMember("link")
+	title, _ := link.GetMember("title")
+	titleStr, _ := title.GetString()
+	assert.Equal(t, "Basic Test Page", titleStr, "Title should be Basic Test Page")
+
+	// delays over the limit are not followed
+	assert.Equal(t, "http://trib.al/x", MetaRefreshURL("5;url=http://trib.al/x", 10*time.Second))
+	assert.Equal(t, "", MetaRefreshURL("30; url=http://trib.al/x", 10*time.Second))
+	assert.Equal(t, "", MetaRefreshURL("0", 10*time.Second))
+}
+
+func TestJSRedirectPatterns(t *testing.T) {
+	fmt.Println(">> Testing js redirect detection...")
+
+	cases := map[string]string{
+		`window.location = "http://a.com/1";`:                  "http://a.com/1",
+		`window.location.href='http://a.com/2'`:                "http://a.com/2",
+		`location.href = "/relative"`:                          "/relative",
+		`location.replace( 'http://a.com/3' );`:                "http://a.com/3",
+		`window.location.replace('http:\/\/trib.al\/QNAQUT9')`: `http:\/\/trib.al\/QNAQUT9`,
+		`document.location="http://a.com/4"`:                   "http://a.com/4",
+		`top.location.assign("http://a.com/5")`:                "http://a.com/5",
+		`if (location.href == "http://a.com/") {}`:             "",
+		`var my_location = "http://a.com/6";`:                  "",
+		`console.log(window.location.hash)`:                    "",
+	}
+	for js, expected := range cases {
+		assert.Equal(t, expected, FindJSRedirect(js), js)
+	}
+
+	jsRedirects := cfg.JSRedirects
+	defer func() { cfg.JSRedirects = jsRedirects }()
+	cfg.JSRedirects.Hosts = []string{"thr.cm"}
+	assert.True(t, cfg.JSRedirects.AppliesTo("thr.cm"), "listed host should be detected")
+	assert.True(t, cfg.JSRedirects.AppliesTo("www.thr.cm"), "listed host subdomain should be detected")
+	assert.False(t, cfg.JSRedirects.AppliesTo("www.google.com"), "unlisted host should not be detected")
+}
+
+func TestUnwrapRules(t *testing.T) {
+	fmt.Println(">> Testing url unwrapping rules...")
+
+	// every rule's examples are checked on load
+	rules, err := LoadUnwrapRules("unwrap.yml")
+	assert.Nil(t, err, "unwrap.yml should load")
+	assert.NotEmpty(t, rules.Rules)
+
+	assert.Equal(t, "https://www.example.com/article", CheckRedirectURL("https://www.google.com/url?q=https://www.example.com/article"))
+	assert.Equal(t, "https://www.example.com/", CheckRedirectURL("https://www.example.com/"), "unwrapped urls should be unchanged")
+
+	// wrappers nested inside each other are unwrapped in turn
+	nested := "https://nam02.safelinks.protection.outlook.com/?url=" +
+		url.QueryEscape("https://l.facebook.com/l.php?u="+url.QueryEscape("https://www.example.com/article"))
+	assert.Equal(t, "https://www.example.com/article", CheckRedirectURL(nested))
+
+	// rules whose examples fail are refused
+	bad := &UnwrapRules{Rules: []UnwrapRule{{
+		Name:     "bad",
+		Domain:   "example.com",
+		Params:   []string{"u"},
+		Examples: []UnwrapExample{{URL: "http://example.com/?u=http://a.com/", Target: "http://b.com/"}},
+	}}}
+	err = bad.Compile()
+	assert.NotNil(t, err, "failing example should be refused")
+}
+
+func TestRedirectChain(t *testing.T) {
+	fmt.Println(">> Testing redirect chain...")
+
+	refresh, _ := ioutil.ReadFile("test/metarefresh.out")
+	basic, _ := ioutil.ReadFile("test/basic.out")
+
+	mock := irukatest.InitMockHTTP()
+	mock.AddTestData("http://refresh.example.com/chain", 200, refresh)
+	mock.AddTestData("http://trib.al/QNAQUT9", 200, basic)
+	defer mock.Close()
+	SetTestClient(mock.Client)
+
+	hash := CacheHash("refresh.example.com/chain")
+	DeleteResult(hash)
+
+	// prepare request, wrapped in a google redirector url
+	wrapped := "https://www.google.com/url?q=" + url.QueryEscape("http://refresh.example.com/chain")
+	reader := strings.NewReader(`{"request": [{"url": "` + wrapped + `"}]}`)
+
+	// perform request
+	resp, err := http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+
+	// Read response
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	assert.Equal(t, 200, resp.StatusCode, "response status code should be 200")
+
+	responseJson, _ := rj.NewParsedJson(body)
+	defer responseJson.Free()
+	respCt := responseJson.GetContainer()
+	responses, _ := respCt.GetMember("response")
+	respArray, _, _ := responses.GetArray()
+	link, _ := respArray[0].GetMember("link")
+	chain, err := link.GetMember("redirectChain")
+	assert.Nil(t, err, "response should have a redirect chain")
+	hops, _, _ := chain.GetArray()
+	assert.Equal(t, 3, len(hops), "chain should have the wrapper, the refresh page and the final page")
+	if len(hops) != 3 {
+		return
+	}
+
+	expected := []struct {
+		url       string
+		status    int
+		mechanism string
+	}{
+		{wrapped, 0, REDIRECT_UNWRAP},
+		{"http://refresh.example.com/chain", 200, REDIRECT_META_REFRESH},
+		{"http://trib.al/QNAQUT9", 200, ""},
+	}
+	for i, hop := range hops {
+		hopUrl, _ := hop.GetMemberOrNil("url").GetString()
+		assert.Equal(t, expected[i].url, hopUrl)
+		status, _ := hop.GetMemberOrNil("status").GetInt()
+		assert.Equal(t, expected[i].status, status)
+		mechanism, _ := hop.GetMemberOrNil("mechanism").GetString()
+		assert.Equal(t, expected[i].mechanism, mechanism)
+		assert.True(t, hop.HasMember("durationMs"), "hop should have its timing")
+	}
+}
+
+func TestFetchDeadline(t *testing.T) {
+	fmt.Println(">> Testing POST / (with a client deadline)...")
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	SetTestClient(NewHTTPClient())
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg.AllowedNets = []*net.IPNet{loopback}
+	defer func() { cfg.AllowedNets = nil }()
+
+	u, _ := url.Parse(slow.URL + "/slow")
+	hash := CacheHash(u.Host + u.Path)
+	DeleteResult(hash)
+
+	// prepare request
+	reader := strings.NewReader(`{"request": [{"url": "` + slow.URL + `/slow"}], "deadlineMs": 100}`)
+
+	// perform request
+	start := time.Now()
+	resp, err := http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+	assert.True(t, time.Since(start) < time.Second, "fetch should stop at the deadline")
+
+	// Read response
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	assert.Equal(t, 203, resp.StatusCode, "response status code should be 203")
+	expected := `{"response":[{"attempts":1,"error":"Fetch deadline exceeded","errorCode":"deadline_exceeded","retryable":true,"cacheHit":false}]}`
+	assert.Equal(t, []byte(expected), body, "deadline response should match")
+
+	// the client's deadline is not cached as the URL's error
+	_, err = GetResult(hash)
+	assert.Equal(t, CacheMiss, err, "deadline errors should not be cached")
+
+	// invalid deadlines are refused
+	reader = strings.NewReader(`{"request": [{"url": "` + slow.URL + `/slow"}], "deadlineMs": -1}`)
+	resp, err = http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode, "response status code should be 400")
+}
+
+// newRedirectServer serves test/basic.out at /page and redirects /redirect
+// to it, counting the connections it accepts.
+func newRedirectServer(newConns *int32) *httptest.Server {
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/page", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	local.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(newConns, 1)
+		}
+	}
+	local.Start()
+	return local
+}
+
+// useLocalhost lets fetches reach local test servers as "localhost" without
+// host limits, and returns a function restoring the config.
+func useLocalhost() func() {
+	limits, transport := cfg.HostLimits, cfg.Transport
+	_, loopback4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, loopback6, _ := net.ParseCIDR("::1/128")
+	cfg.AllowedNets = []*net.IPNet{loopback4, loopback6}
+	cfg.HostLimits = HostLimitsConfig{OnLimit: HOST_LIMIT_QUEUE, MaxWait: time.Second}
+	return func() {
+		cfg.AllowedNets = nil
+		cfg.HostLimits, cfg.Transport = limits, transport
+		SetTestClient(NewHTTPClient())
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	fmt.Println(">> Testing connection reuse...")
+
+	var newConns int32
+	local := newRedirectServer(&newConns)
+	defer local.Close()
+	defer useLocalhost()()
+	cfg.Transport.KeepAlive = true
+	SetTestClient(NewHTTPClient())
+
+	req := strings.Replace(local.URL, "127.0.0.1", "localhost", 1) + "/redirect"
+	u, _ := url.Parse(req)
+	for i := 0; i < 3; i++ {
+		responseJson := rj.NewDoc()
+		err := FetchUrl(context.Background(), req, u, u.Host+u.Path, 0, &RedirectChain{}, responseJson.GetContainerNewObj())
+		responseJson.Free()
+		assert.Nil(t, err, "fetch should not error")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&newConns), "redirects and later fetches should reuse the connection")
+}
+
+func BenchmarkFetchUrl(b *testing.B) {
+	var newConns int32
+	local := newRedirectServer(&newConns)
+	defer local.Close()
+	defer useLocalhost()()
+
+	req := strings.Replace(local.URL, "127.0.0.1", "localhost", 1) + "/redirect"
+	u, _ := url.Parse(req)
+	for _, keepAlive := range []bool{false, true} {
+		b.Run("keepAlive="+strconv.FormatBool(keepAlive), func(b *testing.B) {
+			cfg.Transport.KeepAlive = keepAlive
+			SetTestClient(NewHTTPClient())
+			atomic.StoreInt32(&newConns, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				responseJson := rj.NewDoc()
+				err := FetchUrl(context.Background(), req, u, u.Host+u.Path, 0, &RedirectChain{}, responseJson.GetContainerNewObj())
+				responseJson.Free()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt32(&newConns))/float64(b.N), "conns/op")
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	fmt.Println(">> Testing retries of transient failures...")
+
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	var flakyHits int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			if atomic.AddInt32(&flakyHits, 1) == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/throttled":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+
+	retry := cfg.Retry
+	defer func() { cfg.Retry = retry }()
+	cfg.Retry = RetryConfig{MaxAttempts: 3, BaseDelayMs: 10, MaxDelayMs: 50, MaxRetryAfterSec: 5, RetryStatuses: []int{429, 503}}
+	assert.Nil(t, cfg.Retry.Init(), "retry config should init")
+
+	base := strings.Replace(local.URL, "127.0.0.1", "localhost", 1)
+	for _, path := range []string{"/flaky", "/throttled"} {
+		u, _ := url.Parse(base + path)
+		DeleteResult(CacheHash(u.Host + u.Path))
+	}
+
+	// a 503 is retried and the item succeeds
+	result := ProcessLink(context.Background(), base+"/flaky", CacheOptions{})
+	response := result.docs[0].GetContainer()
+	assert.False(t, response.HasMember("error"), "retried fetch should succeed")
+	attempts, _ := response.GetMemberOrNil("attempts").GetInt()
+	assert.Equal(t, 2, attempts, "item should report both attempts")
+	result.Free()
+
+	// a Retry-After beyond the limit is not waited for
+	result = ProcessLink(context.Background(), base+"/throttled", CacheOptions{})
+	response = result.docs[0].GetContainer()
+	assert.True(t, response.HasMember("error"), "throttled fetch should fail")
+	attempts, _ = response.GetMemberOrNil("attempts").GetInt()
+	assert.Equal(t, 1, attempts, "long Retry-After should not be retried")
+	result.Free()
+
+	// backoff doubles from the base delay, with jitter, up to the max delay
+	unavailable := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+	delay, reason := cfg.Retry.Backoff(1, unavailable, nil)
+	assert.Equal(t, "503", reason)
+	assert.True(t, delay >= 5*time.Millisecond && delay <= 10*time.Millisecond, "first retry should wait about the base delay")
+	delay, _ = cfg.Retry.Backoff(2, unavailable, nil)
+	assert.True(t, delay >= 10*time.Millisecond && delay <= 20*time.Millisecond, "second retry should wait about twice the base delay")
+	_, reason = cfg.Retry.Backoff(3, unavailable, nil)
+	assert.Equal(t, "", reason, "attempts should stop at maxAttempts")
+	_, reason = cfg.Retry.Backoff(1, &http.Response{StatusCode: http.StatusNotFound}, nil)
+	assert.Equal(t, "", reason, "404 should not be retried")
+
+	wait, ok := RetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok && wait > 50*time.Second, "Retry-After dates should be parsed")
+}
+
+func TestErrorCodes(t *testing.T) {
+	fmt.Println(">> Testing error codes...")
+
+	mock := irukatest.InitMockHTTP()
+	defer mock.Close()
+	SetTestClient(mock.Client)
+
+	hash := CacheHash("missing.example.com/page")
+	DeleteResult(hash)
+
+	// prepare request; unknown urls are a 404 in the mock
+	reader := strings.NewReader(`{"request": [{"url": "http://missing.example.com/page"}]}`)
+
+	// perform request
+	resp, err := http.Post(serverUrl, "application/json", reader)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+
+	// Read response
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	assert.Equal(t, 203, resp.StatusCode, "response status code should be 203")
+	responseJson, _ := rj.NewParsedJson(body)
+	defer responseJson.Free()
+	responses, _ := responseJson.GetContainer().GetMember("response")
+	respArray, _, _ := responses.GetArray()
+	code, _ := respArray[0].GetMemberOrNil("errorCode").GetString()
+	assert.Equal(t, ERROR_HTTP_STATUS, code)
+	status, _ := respArray[0].GetMemberOrNil("upstreamStatus").GetInt()
+	assert.Equal(t, 404, status)
+	retryable, _ := respArray[0].GetMemberOrNil("retryable").GetBool()
+	assert.False(t, retryable, "404 should not be retryable")
+
+	cases := []struct {
+		err       error
+		code      string
+		retryable bool
+	}{
+		{&FetchError{Code: ERROR_HTTP_STATUS, Status: 503}, ERROR_HTTP_STATUS, true},
+		{&url.Error{Op: "Get", URL: "http://a.com/", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, ERROR_DNS, false},
+		{&url.Error{Op: "Get", URL: "http://a.com/", Err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}, ERROR_DNS, true},
+		{&url.Error{Op: "Get", URL: "http://a.com/", Err: &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}}, ERROR_TIMEOUT, true},
+		{&url.Error{Op: "Get", URL: "http://a.com/", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}}, ERROR_CONNECTION, true},
+		{&url.Error{Op: "Get", URL: "https://a.com/", Err: x509.UnknownAuthorityError{}}, ERROR_TLS, false},
+		{&url.Error{Op: "parse", URL: "http://a b/", Err: errors.New("invalid character")}, ERROR_PARSE, false},
+		{&PolicyError{Rule: "domain=a.com"}, ERROR_BLACKLISTED, false},
+		{CircuitOpen, ERROR_CIRCUIT_OPEN, true},
+		{errors.New("something else"), ERROR_UNKNOWN, false},
+	}
+	for _, c := range cases {
+		code, _, retryable := ClassifyError(c.err)
+		assert.Equal(t, c.code, code, c.err.Error())
+		assert.Equal(t, c.retryable, retryable, c.err.Error())
+	}
+}
+
+func TestErrorTTL(t *testing.T) {
+	fmt.Println(">> Testing error TTLs...")
+
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	mock := irukatest.InitMockHTTP()
+	mock.AddTestData("http://unblocked.example.com/page", 200, basic)
+	defer mock.Close()
+	SetTestClient(mock.Client)
+
+	errorTTLs := cfg.ErrorTTLs
+	defer func() { cfg.ErrorTTLs = errorTTLs }()
+	var err error
+	cfg.ErrorTTLs, err = InitErrorTTLs(map[string]int{"http_404": 1440, "http_5xx": 2, "timeout": 3})
+	assert.Nil(t, err, "error TTLs should init")
+	_, err = InitErrorTTLs(map[string]int{"http_6xx": 1})
+	assert.NotNil(t, err, "unknown keys should be refused")
+
+	assert.Equal(t, 24*time.Hour, ErrorTTL(&FetchError{Code: ERROR_HTTP_STATUS, Status: 404}))
+	assert.Equal(t, 2*time.Minute, ErrorTTL(&FetchError{Code: ERROR_HTTP_STATUS, Status: 503}))
+	assert.Equal(t, cfg.RedisErrorTTL, ErrorTTL(&FetchError{Code: ERROR_HTTP_STATUS, Status: 403}))
+	assert.Equal(t, 3*time.Minute, ErrorTTL(&url.Error{Op: "Get", URL: "http://a.com/", Err: &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}}))
+
+	// a 404 is cached with its own TTL, and flagged as a cache miss then hit
+	hash := CacheHash("gone.example.com/page")
+	DeleteResult(hash)
+	for _, cacheHit := range []bool{false, true} {
+		result := ProcessLink(context.Background(), "http://gone.example.com/page", CacheOptions{})
+		hit, err := result.docs[0].GetContainer().GetMemberOrNil("cacheHit").GetBool()
+		assert.Nil(t, err, "error items should have cacheHit")
+		assert.Equal(t, cacheHit, hit)
+		result.Free()
+	}
+	ttl, _ := cache.TTL(ResultKey(hash))
+	assert.True(t, ttl > 23*time.Hour, "404 should be cached for its own TTL")
+
+	// blacklisted errors cached under another policy are refetched
+	hash = CacheHash("unblocked.example.com/page")
+	SetResult(hash, `{"error":"Invalid URL (blacklisted)","errorCode":"blacklisted","retryable":false}`, time.Hour)
+	cache.Set(POLICY_KEY_PREFIX+hash, "old", time.Hour)
+	result := ProcessLink(context.Background(), "http://unblocked.example.com/page", CacheOptions{})
+	response := result.docs[0].GetContainer()
+	assert.False(t, response.HasMember("error"), "stale blacklisted error should not be served")
+	result.Free()
+	DeleteResult(hash)
+
+	// redirects to blocked URLs are cached under the current policy, which is
+	// not part of the item
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://blocked.example.com/", http.StatusMovedPermanently)
+	}))
+	defer redirecting.Close()
+	SetTestClient(NewHTTPClient())
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	cfg.AllowedNets = []*net.IPNet{loopback}
+	defer func() { cfg.AllowedNets = nil }()
+	policy := cfg.Policy
+	defer func() { cfg.Policy = policy }()
+	cfg.Policy = Policy{Rules: []PolicyRule{{Domain: "blocked.example.com", Action: POLICY_ACTION_DENY}}}
+	assert.Nil(t, cfg.Policy.Compile(), "policy should compile")
+
+	u, _ := url.Parse(redirecting.URL + "/page")
+	hash = CacheHash(u.Host + u.Path)
+	DeleteResult(hash)
+	for _, cacheHit := range []bool{false, true} {
+		result = ProcessLink(context.Background(), u.String(), CacheOptions{})
+		response = result.docs[0].GetContainer()
+		code, _ := response.GetMemberOrNil("errorCode").GetString()
+		assert.Equal(t, ERROR_BLACKLISTED, code, "redirect to a blocked URL should error")
+		hit, _ := response.GetMemberOrNil("cacheHit").GetBool()
+		assert.Equal(t, cacheHit, hit)
+		assert.False(t, response.HasMember("policyVersion"), "policy version should not be served")
+		result.Free()
+	}
+
+	// error TTLs must be positive
+	_, err = InitErrorTTLs(map[string]int{"http_404": 0})
+	assert.NotNil(t, err, "zero error TTL should be refused")
+}
+
+func TestCacheControl(t *testing.T) {
+	fmt.Println(">> Testing Cache-Control TTLs and revalidation...")
+
+	now := time.Now()
+	ttl, ok := HeaderTTL(http.Header{"Cache-Control": {"public, max-age=600"}}, now)
+	assert.True(t, ok && ttl == 10*time.Minute, "max-age should give the TTL")
+	ttl, _ = HeaderTTL(http.Header{"Cache-Control": {"max-age=600, s-maxage=60"}, "Age": {"20"}}, now)
+	assert.Equal(t, 40*time.Second, ttl, "s-maxage should win, less the age")
+	ttl, ok = HeaderTTL(http.Header{"Cache-Control": {"no-cache"}, "Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, now)
+	assert.True(t, ok && ttl == 0, "no-cache should give no TTL")
+	ttl, _ = HeaderTTL(http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, now)
+	assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour, "Expires should give the TTL")
+	_, ok = HeaderTTL(http.Header{}, now)
+	assert.False(t, ok, "no caching headers should give no TTL")
+
+	cacheControl, stale := cfg.CacheControl, cfg.Stale
+	defer func() { cfg.CacheControl, cfg.Stale = cacheControl, stale }()
+	cfg.Stale.Enabled = false
+	cfg.CacheControl = CacheControlConfig{Enabled: true, MinTTLMins: 10, MaxTTLHours: 1}
+	cfg.CacheControl.Init()
+	assert.Equal(t, 10*time.Minute, cfg.CacheControl.ResultTTL(http.Header{"Cache-Control": {"max-age=5"}}))
+	assert.Equal(t, time.Hour, cfg.CacheControl.ResultTTL(http.Header{"Cache-Control": {"max-age=86400"}}))
+	assert.Equal(t, cfg.RedisTTL, cfg.CacheControl.ResultTTL(http.Header{}))
+
+	// results that are immediately stale are revalidated with a conditional GET
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	var notModified int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag.Load().(string))
+		w.Header().Set("Cache-Control", "max-age=0")
+		if r.Header.Get("If-None-Match") == etag.Load().(string) {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+	cfg.CacheControl = CacheControlConfig{Enabled: true}
+	cfg.CacheControl.Init()
+
+	live := strings.Replace(local.URL, "127.0.0.1", "localhost", 1) + "/live"
+	u, _ := url.Parse(live)
+	DeleteResult(CacheHash(u.Host + u.Path))
+	for i, expected := range []struct {
+		cacheHit    bool
+		notModified int32
+	}{{false, 0}, {true, 1}, {false, 1}} {
+		if i == 2 {
+			etag.Store(`"v2"`)
+		}
+		result := ProcessLink(context.Background(), live, CacheOptions{})
+		response := result.docs[0].GetContainer()
+		cacheHit, _ := response.GetMemberOrNil("cacheHit").GetBool()
+		assert.Equal(t, expected.cacheHit, cacheHit)
+		assert.Equal(t, expected.notModified, atomic.LoadInt32(&notModified))
+		title, _ := response.GetMemberOrNil("title").GetString()
+		assert.Equal(t, "Basic Test Page", title, "revalidated results should be served")
+		result.Free()
+	}
+
+	// the validators belong to the fetched URL, not the canonical one
+	var canonicalHits int32
+	canonicalPage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		if r.URL.Path == "/canonical" {
+			atomic.AddInt32(&canonicalHits, 1)
+			w.Header().Set("ETag", `"other"`)
+		} else {
+			w.Header().Set("ETag", `"page"`)
+			if r.Header.Get("If-None-Match") == `"page"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><head><title>Canonical</title><link rel="canonical" href="http://%s/canonical"></head><body></body></html>`, r.Host)
+	}))
+	defer canonicalPage.Close()
+	page := strings.Replace(canonicalPage.URL, "127.0.0.1", "localhost", 1) + "/page"
+	u, _ = url.Parse(page)
+	DeleteResult(CacheHash(u.Host + u.Path))
+	DeleteResult(CacheHash(u.Host + "/canonical"))
+	for _, expected := range []bool{false, true} {
+		result := ProcessLink(context.Background(), page, CacheOptions{})
+		response := result.docs[0].GetContainer()
+		cacheHit, _ := response.GetMemberOrNil("cacheHit").GetBool()
+		assert.Equal(t, expected, cacheHit, "the page should revalidate against the URL it was fetched from")
+		validatorUrl, _ := response.GetMemberOrNil("validatorUrl").GetString()
+		assert.Equal(t, page, validatorUrl)
+		result.Free()
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&canonicalHits), "the canonical URL should not be revalidated")
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	fmt.Println(">> Testing stale-while-revalidate...")
+
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	var fetches, failing int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+
+	cacheControl, stale := cfg.CacheControl, cfg.Stale
+	defer func() { cfg.CacheControl, cfg.Stale = cacheControl, stale }()
+	cfg.CacheControl = CacheControlConfig{Enabled: true}
+	cfg.CacheControl.Init()
+	cfg.Stale = StaleConfig{Enabled: true, SoftTTLHours: 1, RefreshLockSec: 60}
+	cfg.Stale.Init()
+
+	page := strings.Replace(local.URL, "127.0.0.1", "localhost", 1) + "/swr"
+	u, _ := url.Parse(page)
+	hash := CacheHash(u.Host + u.Path)
+	DeleteResult(hash)
+	cache.Delete(REFRESH_LOCK_PREFIX + hash)
+
+	result := ProcessLink(context.Background(), page, CacheOptions{})
+	assert.False(t, result.docs[0].GetContainer().HasMember("stale"), "fetched result should not be stale")
+	result.Free()
+
+	// the stale result is served at once and refreshed in the background
+	for i := 0; i < 2; i++ {
+		result = ProcessLink(context.Background(), page, CacheOptions{})
+		response := result.docs[0].GetContainer()
+		isStale, _ := response.GetMemberOrNil("stale").GetBool()
+		assert.True(t, isStale, "result past its TTL should be served stale")
+		title, _ := response.GetMemberOrNil("title").GetString()
+		assert.Equal(t, "Basic Test Page", title)
+		result.Free()
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&fetches) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches), "stale result should be refreshed once while locked")
+	cache.Delete(REFRESH_LOCK_PREFIX + hash)
+
+	// a failed refresh keeps the stale result and releases the lock
+	atomic.StoreInt32(&failing, 1)
+	result = ProcessLink(context.Background(), page, CacheOptions{})
+	isStale, _ := result.docs[0].GetContainer().GetMemberOrNil("stale").GetBool()
+	assert.True(t, isStale, "stale result should be served while refreshing")
+	result.Free()
+	for i := 0; i < 100 && atomic.LoadInt32(&fetches) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, err := cache.Get(REFRESH_LOCK_PREFIX + hash)
+	assert.Equal(t, CacheMiss, err, "failed refresh should release the lock")
+	_, err = GetResult(hash)
+	assert.Nil(t, err, "failed refresh should keep the stale result")
+
+	// stale results are still refreshed without refreshLockSec
+	atomic.StoreInt32(&failing, 0)
+	cfg.Stale = StaleConfig{Enabled: true, SoftTTLHours: 1}
+	cfg.Stale.Init()
+	assert.Equal(t, DEFAULT_REFRESH_LOCK, cfg.Stale.RefreshLock, "refresh lock should have a default")
+	before := atomic.LoadInt32(&fetches)
+	ProcessLink(context.Background(), page, CacheOptions{}).Free()
+	for i := 0; i < 100 && atomic.LoadInt32(&fetches) == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, before+1, atomic.LoadInt32(&fetches), "stale result should be refreshed without refreshLockSec")
+	time.Sleep(50 * time.Millisecond)
+	cache.Delete(REFRESH_LOCK_PREFIX + hash)
+}
+
+func TestCoalesce(t *testing.T) {
+	fmt.Println(">> Testing coalescing of concurrent fetches...")
+
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	var fetches int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+
+	page := strings.Replace(local.URL, "127.0.0.1", "localhost", 1) + "/coalesce"
+	u, _ := url.Parse(page)
+	hash := CacheHash(u.Host + u.Path)
+	DeleteResult(hash)
+
+	// concurrent requests share a single fetch and get the same result
+	results := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result := ProcessLink(context.Background(), page, CacheOptions{})
+			results[i] = result.docs[0].GetContainer().String()
+			result.Free()
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches), "concurrent requests should share one fetch")
+	for _, result := range results {
+		assert.Contains(t, result, `"title":"Basic Test Page"`)
+		assert.Equal(t, results[0], result, "concurrent requests should get the same result")
+	}
+
+	// a caller giving up does not cancel the fetch for the others
+	DeleteResult(hash)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan string)
+	go func() {
+		result := ProcessLink(context.Background(), page, CacheOptions{})
+		done <- result.docs[0].GetContainer().String()
+		result.Free()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	result := ProcessLink(ctx, page, CacheOptions{})
+	assert.Contains(t, result.docs[0].GetContainer().String(), `"errorCode":"deadline_exceeded"`)
+	result.Free()
+	assert.Contains(t, <-done, `"title":"Basic Test Page"`, "remaining caller should get the fetched result")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// with the fleet lock, a fetch locked by another instance is waited for
+	coalesce := cfg.Coalesce
+	defer func() { cfg.Coalesce = coalesce }()
+	cfg.Coalesce = CoalesceConfig{FleetLock: true, Poll: 10 * time.Millisecond}
+	DeleteResult(hash)
+	cache.Set(FETCH_LOCK_PREFIX+hash, "other", time.Minute)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		SetResult(hash, `{"title":"Fetched Elsewhere"}`, time.Minute)
+		cache.Set(FETCH_DONE_PREFIX+hash, "other", time.Minute)
+		cache.Delete(FETCH_LOCK_PREFIX + hash)
+	}()
+	result = ProcessLink(context.Background(), page, CacheOptions{})
+	assert.Contains(t, result.docs[0].GetContainer().String(), `"title":"Fetched Elsewhere"`)
+	result.Free()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches), "locked fetch should not be repeated")
+
+	// callers skipping the cache do not get the result cached before the
+	// locked fetch either
+	cache.Set(FETCH_LOCK_PREFIX+hash, "another", time.Minute)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		SetResult(hash, `{"title":"Fetched Again Elsewhere"}`, time.Minute)
+		cache.Set(FETCH_DONE_PREFIX+hash, "another", time.Minute)
+		cache.Delete(FETCH_LOCK_PREFIX + hash)
+	}()
+	result = ProcessLink(context.Background(), page, CacheOptions{NoCache: true})
+	assert.Contains(t, result.docs[0].GetContainer().String(), `"title":"Fetched Again Elsewhere"`)
+	result.Free()
+
+	// a lock released without a result is taken over
+	DeleteResult(hash)
+	cache.Set(FETCH_LOCK_PREFIX+hash, "failed", time.Minute)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cache.Delete(FETCH_LOCK_PREFIX + hash)
+	}()
+	result = ProcessLink(context.Background(), page, CacheOptions{})
+	assert.Contains(t, result.docs[0].GetContainer().String(), `"title":"Basic Test Page"`)
+	result.Free()
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches), "released lock should be taken over")
+	_, err := cache.Get(FETCH_LOCK_PREFIX + hash)
+	assert.Equal(t, CacheMiss, err, "fetch lock should be released")
+	DeleteResult(hash)
+
+	// a panicking fetch fails its callers without blocking later ones
+	for i := 0; i < 2; i++ {
+		respStr, _, err := CoalesceFetch(context.Background(), "panic", &RedirectChain{}, func(ctx context.Context) string {
+			panic("fetch panic")
+		})
+		assert.Nil(t, err, "panicking fetch should still return")
+		assert.Contains(t, respStr, `"errorCode":"unknown"`)
+	}
+}
+
+// checkCache exercises the Cache contract on c.
+func checkCache(t *testing.T, c Cache, name string) {
+	c.Delete("cache-test")
+	_, err := c.Get("cache-test")
+	assert.Equal(t, CacheMiss, err, name+" should miss unset keys")
+	_, err = c.TTL("cache-test")
+	assert.Equal(t, CacheMiss, err, name+" should have no TTL for unset keys")
+
+	assert.Nil(t, c.Set("cache-test", "value", time.Minute))
+	value, err := c.Get("cache-test")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", value, name+" should return set values")
+	ttl, err := c.TTL("cache-test")
+	assert.Nil(t, err)
+	assert.True(t, ttl > 50*time.Second && ttl <= time.Minute, name+" should keep the TTL")
+
+	locked, err := c.SetNX("cache-test", "other", time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, locked, name+" SetNX should not replace set keys")
+	assert.Nil(t, c.Delete("cache-test"))
+	locked, _ = c.SetNX("cache-test", "other", time.Minute)
+	assert.True(t, locked, name+" SetNX should set deleted keys")
+	value, _ = c.Get("cache-test")
+	assert.Equal(t, "other", value)
+
+	c.Set("cache-test", "expiring", 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	_, err = c.Get("cache-test")
+	assert.Equal(t, CacheMiss, err, name+" should expire keys")
+
+	// keys are never stored without a positive TTL
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		c.Set("cache-test", "value", time.Minute)
+		assert.Nil(t, c.Set("cache-test", "forever", ttl))
+		_, err = c.Get("cache-test")
+		assert.Equal(t, CacheMiss, err, name+" Set should delete keys without a positive TTL")
+		locked, err = c.SetNX("cache-test", "forever", ttl)
+		assert.Nil(t, err)
+		assert.False(t, locked, name+" SetNX should not set keys without a positive TTL")
+		_, err = c.Get("cache-test")
+		assert.Equal(t, CacheMiss, err, name+" SetNX should not set keys without a positive TTL")
+	}
+
+	for _, key := range []string{"cache-test:a/1", "cache-test:a/2", "cache-test:a*/3", "cache-test:b/1"} {
+		c.Set(key, "value", time.Minute)
+	}
+	deleted, err := c.DeletePrefix("cache-test:a*/")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted, name+" should match prefixes literally")
+	deleted, _ = c.DeletePrefix("cache-test:a/")
+	assert.Equal(t, 2, deleted, name+" should delete keys with the prefix")
+	_, err = c.Get("cache-test:b/1")
+	assert.Nil(t, err, name+" should keep keys without the prefix")
+	c.Delete("cache-test:b/1")
+}
+
+func TestCacheBackends(t *testing.T) {
+	fmt.Println(">> Testing cache backends...")
+
+	checkCache(t, NewLRUCache(0, 0), "lru")
+	checkCache(t, NewTieredCache(NewLRUCache(0, 0), NewLRUCache(0, 0), time.Minute), "tiered")
+
+	// the LRU evicts the least recently used entries beyond its limits
+	lru := NewLRUCache(3, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		lru.Set(key, key, time.Minute)
+	}
+	lru.Get("a")
+	lru.Set("d", "d", time.Minute)
+	_, err := lru.Get("b")
+	assert.Equal(t, CacheMiss, err, "least recently used entry should be evicted")
+	assert.Equal(t, 3, lru.Len())
+	lru = NewLRUCache(0, 10)
+	lru.Set("a", "12345", time.Minute)
+	lru.Set("b", "12345", time.Minute)
+	assert.Equal(t, 1, lru.Len(), "entries beyond the size limit should be evicted")
+	_, err = lru.Get("b")
+	assert.Nil(t, err)
+
+	// the tiered cache serves from the LRU, which drops entries after its TTL
+	local, remote := NewLRUCache(0, 0), NewLRUCache(0, 0)
+	tiered := NewTieredCache(local, remote, 50*time.Millisecond)
+	tiered.Set("a", "1", time.Minute)
+	remote.Set("a", "2", time.Minute)
+	value, _ := tiered.Get("a")
+	assert.Equal(t, "1", value, "tiered cache should serve from the LRU")
+	time.Sleep(60 * time.Millisecond)
+	value, _ = tiered.Get("a")
+	assert.Equal(t, "2", value, "tiered cache should go to the shared cache after the LRU TTL")
+	locked, _ := tiered.SetNX("lock", "1", time.Minute)
+	assert.True(t, locked)
+	_, err = local.Get("lock")
+	assert.Equal(t, CacheMiss, err, "locks should only be taken in the shared cache")
+
+	// redis is only checked when one is running
+	client := redis.NewClient(&redis.Options{Addr: cfg.RedisHost, DB: cfg.RedisDB})
+	defer client.Close()
+	if client.Ping(context.Background()).Err() != nil {
+		t.Skip("no redis on " + cfg.RedisHost)
+	}
+	checkCache(t, NewRedisCache(client, time.Second), "redis")
+
+	// a cluster refuses DELs of keys in different slots, which a host's keys
+	// usually are; here one server holds all the slots, and DELs of several
+	// keys are refused like the cluster would
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{
+		ClusterSlots: func(ctx context.Context) ([]redis.ClusterSlot, error) {
+			return []redis.ClusterSlot{{Start: 0, End: 16383, Nodes: []redis.ClusterNode{{Addr: cfg.RedisHost}}}}, nil
+		},
+	})
+	defer cluster.Close()
+	cluster.OnNewNode(func(node *redis.Client) {
+		node.AddHook(crossSlotHook{})
+	})
+	checkCache(t, NewRedisCache(cluster, time.Second), "redis cluster")
+}
+
+// crossSlotHook fails DEL commands of more than one key with the error of a
+// cluster whose keys are in different slots.
+type crossSlotHook struct{}
+
+func (crossSlotHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (crossSlotHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		return crossSlotCheck(next(ctx, cmd), cmd)
+	}
+}
+
+func (crossSlotHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		for _, cmd := range cmds {
+			err = crossSlotCheck(err, cmd)
+		}
+		return err
+	}
+}
+
+func crossSlotCheck(err error, cmd redis.Cmder) error {
+	if cmd.Name() == "del" && len(cmd.Args()) > 2 {
+		cmd.SetErr(errors.New("CROSSSLOT Keys in request don't hash to the same slot"))
+		return cmd.Err()
+	}
+	return err
+}
+
+func TestRedisOutage(t *testing.T) {
+	fmt.Println(">> Testing redis outages...")
+
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+
+	// a redis that cannot be reached is marked down when the cache is created
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+	client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	defer client.Close()
+	down := NewRedisCache(client, time.Minute)
+	_, err := down.Get("key")
+	assert.Equal(t, CacheUnavailable, err, "unreachable redis should be unavailable")
+	assert.Equal(t, CacheUnavailable, down.Set("key", "value", time.Minute))
+
+	previous := cache
+	defer func() { cache = previous }()
+	cache = down
+
+	// links are still fetched, uncached
+	for i := 0; i < 2; i++ {
+		result := ProcessLink(context.Background(), strings.Replace(local.URL, "127.0.0.1", "localhost", 1)+"/outage", CacheOptions{})
+		response := result.docs[0].GetContainer().String()
+		assert.Contains(t, response, `"title":"Basic Test Page"`, "links should be fetched while redis is down")
+		assert.Contains(t, response, `"cacheHit":false`)
+		assert.Equal(t, http.StatusOK, result.respCode)
+		result.Free()
+	}
+
+	// readiness reflects the outage
+	resp, err := http.Get(serverUrl + "ready")
+	assert.Nil(t, err, "request should not error")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, `{"ready":false,"error":"Cache unavailable"}`, string(body))
+	cache = previous
+	resp, err = http.Get(serverUrl + "ready")
+	assert.Nil(t, err, "request should not error")
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"ready":true}`, string(body))
+
+	// redis is used again once it answers; only checked when one is running
+	client = redis.NewClient(&redis.Options{Addr: cfg.RedisHost, DB: cfg.RedisDB})
+	defer client.Close()
+	if client.Ping(context.Background()).Err() != nil {
+		t.Skip("no redis on " + cfg.RedisHost)
+	}
+	recovering := NewRedisCache(client, 10*time.Millisecond)
+	recovering.check(io.ErrUnexpectedEOF)
+	assert.Equal(t, CacheUnavailable, recovering.Ready(), "redis should be marked down after connection errors")
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, recovering.Ready(), "redis should be used again once it answers")
+}
+
+func TestCacheEntries(t *testing.T) {
+	fmt.Println(">> Testing versioned and compressed cache entries...")
+
+	result := `{"title":"` + strings.Repeat("Basic Test Page ", 100) + `","cacheHit":false}`
+	for _, compression := range []string{COMPRESS_NONE, COMPRESS_SNAPPY, COMPRESS_ZSTD} {
+		entry := EncodeResult(result, compression, 0)
+		assert.True(t, strings.HasPrefix(entry, "1.1."+compression+":"), "entry should start with its versions and compression")
+		if compression != COMPRESS_NONE {
+			assert.True(t, len(entry) < len(result)/4, compression+" should compress the result")
+		}
+		decoded, err := DecodeResult(entry)
+		assert.Nil(t, err)
+		assert.Equal(t, result, decoded, compression+" entries should decode to the result")
+	}
+	assert.Equal(t, "1.1.none:{}", EncodeResult("{}", COMPRESS_ZSTD, 512), "short results should not be compressed")
+
+	// entries of other versions and unreadable entries are misses
+	hash := "0123456789abcdef0123456789abcdef"
+	assert.Equal(t, "link:v1.1:"+hash, ResultKey(hash))
+	cache.Set(ResultKey(hash), "1.0.none:{}", time.Minute)
+	_, err := GetResult(hash)
+	assert.Equal(t, CacheMiss, err, "entries of an older extractor should be misses")
+	cache.Set(ResultKey(hash), "{}", time.Minute)
+	_, err = GetResult(hash)
+	assert.Equal(t, CacheMiss, err, "entries without a header should be misses")
+	cache.Set(ResultKey(hash), "1.1.zstd:{}", time.Minute)
+	_, err = GetResult(hash)
+	assert.Equal(t, CacheMiss, err, "corrupt entries should be misses")
+	DeleteResult(hash)
+
+	// results are read back whatever compression they were stored with
+	compression := cfg.Cache.Compression
+	defer func() { cfg.Cache.Compression = compression }()
+	cfg.Cache.Compression = COMPRESS_SNAPPY
+	SetResult(hash, result, time.Minute)
+	cfg.Cache.Compression = COMPRESS_ZSTD
+	cached, err := GetResult(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, result, cached)
+	DeleteResult(hash)
+
+	// the key prefix applies to every key
+	lru := NewLRUCache(0, 0)
+	prefixed := prefixCache{prefix: "staging:", Cache: lru}
+	prefixed.Set("robots:http://example.com", "", time.Minute)
+	locked, _ := prefixed.SetNX("refresh:"+hash, "1", time.Minute)
+	assert.True(t, locked)
+	_, err = lru.Get("staging:robots:http://example.com")
+	assert.Nil(t, err, "keys should be stored with the prefix")
+	_, err = lru.Get("staging:refresh:" + hash)
+	assert.Nil(t, err, "locks should be stored with the prefix")
+	prefixed.Delete("robots:http://example.com")
+	assert.Equal(t, 1, lru.Len())
+}
+
+// adminRequest sends an admin request to the test server and returns the
+// status code and body.
+func adminRequest(t *testing.T, method string, path string, token string) (int, string) {
+	req, _ := http.NewRequest(method, serverUrl+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestAdmin(t *testing.T) {
+	fmt.Println(">> Testing cache administration routes...")
+
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	var fetches int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+
+	base := strings.Replace(local.URL, "127.0.0.1", "localhost", 1)
+	host := strings.TrimPrefix(base, "http://")
+	page := url.QueryEscape(base + "/admin?utm_source=test")
+	cache.DeletePrefix(HostResultsPrefix(host))
+
+	// the routes are disabled without a token and need the token
+	status, _ := adminRequest(t, "GET", "admin/cache?url="+page, "")
+	assert.Equal(t, http.StatusNotFound, status, "admin routes should be disabled without a token")
+	token := cfg.Admin.Token
+	defer func() { cfg.Admin.Token = token }()
+	cfg.Admin.Token = "secret"
+	status, body := adminRequest(t, "GET", "admin/cache?url="+page, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, `{"error":"Unauthorized"}`, body)
+	req, _ := http.NewRequest("GET", serverUrl+"admin/cache?url="+page, nil)
+	req.Header.Set("Authorization", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err, "request should not error")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "the token should be sent as a bearer token")
+	status, _ = adminRequest(t, "GET", "admin/cache", "secret")
+	assert.Equal(t, http.StatusBadRequest, status, "lookups should need a url")
+
+	// nothing is cached yet
+	status, body = adminRequest(t, "GET", "admin/cache?url="+page, "secret")
+	assert.Equal(t, http.StatusNotFound, status)
+	hash := CacheHash(host + "/admin")
+	assert.Equal(t, `{"url":"`+host+`/admin","key":"`+ResultKey(hash)+`","cached":false}`, body)
+
+	// a forced refresh fetches the URL even when it is cached
+	for i := 1; i <= 2; i++ {
+		status, body = adminRequest(t, "POST", "admin/refresh?url="+page, "secret")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, `"title":"Basic Test Page"`)
+		assert.Equal(t, int32(i), atomic.LoadInt32(&fetches), "refresh should bypass the cache")
+	}
+
+	// lookups use the same normalization as requests
+	status, body = adminRequest(t, "GET", "admin/cache?url="+url.QueryEscape(base+"/admin?utm_medium=x"), "secret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"cached":true,"ttlSec":`)
+	assert.Contains(t, body, `"result":{`)
+	assert.Contains(t, body, `"title":"Basic Test Page"`)
+
+	// purging a URL drops its result
+	status, body = adminRequest(t, "DELETE", "admin/cache?url="+page, "secret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"url":"`+host+`/admin","purged":1}`, body)
+	status, _ = adminRequest(t, "GET", "admin/cache?url="+page, "secret")
+	assert.Equal(t, http.StatusNotFound, status, "purged URL should not be cached")
+
+	// other instances may serve purged results from their LRU for a while
+	backend := cfg.Cache.Backend
+	defer func() { cfg.Cache.Backend = backend }()
+	cfg.Cache.Backend = CACHE_TIERED
+	status, body = adminRequest(t, "DELETE", "admin/cache?url="+page, "secret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"url":"`+host+`/admin","purged":0,"localCacheTTLsec":`+strconv.Itoa(cfg.Cache.LRUTTLSec)+`}`, body)
+	cfg.Cache.Backend = backend
+
+	// purging a host drops all of its results and nothing else
+	for _, path := range []string{"/one", "/two?id=2"} {
+		ProcessLink(context.Background(), base+path, CacheOptions{}).Free()
+	}
+	SetResult(CacheHash("other.example.com/page"), "{}", time.Minute)
+	status, body = adminRequest(t, "DELETE", "admin/cache/hosts/"+host, "secret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"host":"`+host+`","purged":2}`, body)
+	_, err = GetResult(CacheHash(host + "/one"))
+	assert.Equal(t, CacheMiss, err, "results for the host should be purged")
+	_, err = GetResult(CacheHash("other.example.com/page"))
+	assert.Nil(t, err, "results for other hosts should be kept")
+	DeleteResult(CacheHash("other.example.com/page"))
+}
+
+// postLinks sends a links request body to the test server and returns the
+// status code and body.
+func postLinks(t *testing.T, request string) (int, string) {
+	resp, err := http.Post(serverUrl, "application/json", strings.NewReader(request))
+	assert.Nil(t, err, "request should not error")
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err, "should not error reading response")
+	return resp.StatusCode, string(body)
+}
+
+func TestCacheOptions(t *testing.T) {
+	fmt.Println(">> Testing per-request cache options...")
+
+	basic, _ := ioutil.ReadFile("test/basic.out")
+	var fetches int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(basic)
+	}))
+	defer local.Close()
+	defer useLocalhost()()
+	SetTestClient(NewHTTPClient())
+
+	page := strings.Replace(local.URL, "127.0.0.1", "localhost", 1) + "/options"
+	u, _ := url.Parse(page)
+	hash := CacheHash(u.Host + u.Path)
+	DeleteResult(hash)
+
+	// onlyIfCached never fetches
+	status, body := postLinks(t, `{"request": [{"url": "`+page+`"}], "onlyIfCached": true}`)
+	assert.Equal(t, 203, status)
+	assert.Equal(t, `{"response":[{"error":"Not cached","errorCode":"not_cached","retryable":true,"cacheHit":false}]}`, body)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&fetches), "onlyIfCached should not fetch")
+
+	// noStore fetches without caching the result
+	status, body = postLinks(t, `{"request": [{"url": "`+page+`", "noStore": true}]}`)
+	assert.Equal(t, 200, status)
+	assert.Contains(t, body, `"title":"Basic Test Page"`)
+	_, err := GetResult(hash)
+	assert.Equal(t, CacheMiss, err, "noStore results should not be cached")
+
+	// a cached result is served to onlyIfCached items, and skipped by noCache
+	postLinks(t, `{"request": [{"url": "`+page+`"}]}`)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	status, body = postLinks(t, `{"request": [{"url": "`+page+`", "onlyIfCached": true}]}`)
+	assert.Equal(t, 200, status)
+	assert.Contains(t, body, `"cacheHit":true`)
+	status, body = postLinks(t, `{"request": [{"url": "`+page+`"}, {"url": "`+page+`", "noCache": false}], "noCache": true}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches), "noCache should fetch, items may override it")
+	assert.Contains(t, body, `"cacheHit":false`)
+	assert.Contains(t, body, `"cacheHit":true`)
+
+	// maxAge only accepts results fetched recently enough
+	fetchedAt := strconv.Itoa(int(time.Now().Add(-time.Hour).Unix()))
+	SetResult(hash, `{"title":"Old Page","fetchedAt":`+fetchedAt+`,"maxAge":86400}`, time.Hour)
+	_, body = postLinks(t, `{"request": [{"url": "`+page+`", "maxAge": 7200}]}`)
+	assert.Contains(t, body, `"title":"Old Page"`, "results younger than maxAge should be served")
+	_, body = postLinks(t, `{"request": [{"url": "`+page+`", "maxAge": 60, "onlyIfCached": true}]}`)
+	assert.Contains(t, body, `"errorCode":"not_cached"`, "results older than maxAge should not be served")
+	_, body = postLinks(t, `{"request": [{"url": "`+page+`"}], "maxAge": 60}`)
+	assert.Contains(t, body, `"title":"Basic Test Page"`, "results older than maxAge should be fetched again")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&fetches))
+	_, body = postLinks(t, `{"request": [{"url": "`+page+`", "maxAge": 0}]}`)
+	assert.Contains(t, body, `"cacheHit":false`, "maxAge 0 should fetch again")
+	assert.Equal(t, int32(5), atomic.LoadInt32(&fetches))
+
+	// invalid options are refused
+	status, body = postLinks(t, `{"request": [{"url": "`+page+`"}], "noCache": "yes"}`)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, `{"error":"Unable to parse request - noCache must be a boolean"}`, body)
+	status, body = postLinks(t, `{"request": [{"url": "`+page+`", "maxAge": -1}]}`)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, `{"response":[{"error":"maxAge must be a number of seconds","errorCode":"invalid_request","retryable":false}]}`, body)
+	DeleteResult(hash)
+}
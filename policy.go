@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	POLICY_MODE_BLOCKLIST = "blocklist" // fetch everything except URLs matching a deny rule
+	POLICY_MODE_ALLOWLIST = "allowlist" // fetch only URLs matching an allow rule
+
+	POLICY_ACTION_ALLOW = "allow"
+	POLICY_ACTION_DENY  = "deny"
+
+	POLICY_KEY_PREFIX = "policy:" // policy version of cached blacklisted errors
+)
+
+// Policy decides which URLs may be fetched. Rules are evaluated in order and
+// the first matching rule decides; URLs matching no rule are allowed in
+// blocklist mode and denied in allowlist mode.
+type Policy struct {
+	Mode  string       `yaml:"mode"`
+	Rules []PolicyRule `yaml:"rules"`
+
+	Version string // changes whenever the mode or rules do
+}
+
+// PolicyRule matches URLs on any combination of host, domain, path prefix and
+// regex; every field that is set has to match. Domain "example.com" matches
+// the domain and all of its subdomains, "*.example.com" only the subdomains.
+// The regex is matched against host + path + query.
+type PolicyRule struct {
+	Host       string `yaml:"host"`
+	Domain     string `yaml:"domain"`
+	PathPrefix string `yaml:"pathPrefix"`
+	Regex      string `yaml:"regex"`
+	Action     string `yaml:"action"`
+
+	re    *regexp.Regexp
+	allow bool
+	name  string
+}
+
+// PolicyError is returned for URLs refused by the policy. Rule names the
+// rule that matched, or the mode when no rule did.
+type PolicyError struct {
+	Rule string
+}
+
+func (e *PolicyError) Error() string {
+	return "Invalid URL (blacklisted)"
+}
+
+// AddBlacklist turns the domains of the old blacklist setting into deny
+// rules ahead of the configured ones, so that configs still listing them
+// keep blocking those domains in either mode. It must be called before
+// Compile.
+func (p *Policy) AddBlacklist(domains []string) {
+	var rules []PolicyRule
+	for _, domain := range domains {
+		rules = append(rules, PolicyRule{Domain: domain, Action: POLICY_ACTION_DENY})
+	}
+	p.Rules = append(rules, p.Rules...)
+}
+
+// Compile validates the policy and prepares its rules for matching.
+func (p *Policy) Compile() error {
+	if p.Mode == "" {
+		p.Mode = POLICY_MODE_BLOCKLIST
+	}
+	if p.Mode != POLICY_MODE_BLOCKLIST && p.Mode != POLICY_MODE_ALLOWLIST {
+		return errors.New("invalid policy mode: " + p.Mode)
+	}
+
+	var names []string
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		rule.Host = PolicyHost(rule.Host)
+		if domain := strings.TrimPrefix(rule.Domain, "*."); domain != rule.Domain {
+			rule.Domain = "*." + PolicyHost(domain)
+		} else {
+			rule.Domain = PolicyHost(rule.Domain)
+		}
+		if rule.Host == "" && rule.Domain == "" && rule.PathPrefix == "" && rule.Regex == "" {
+			return errors.New("policy rule " + rule.String() + " has nothing to match")
+		}
+
+		// refuse rules that would match a whole public suffix such as "co.uk"
+		if domain := strings.TrimPrefix(rule.Domain, "*."); domain != "" {
+			if suffix, _ := publicsuffix.PublicSuffix(domain); suffix == domain {
+				return errors.New("policy rule " + rule.String() + " matches a public suffix")
+			}
+		}
+
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return errors.New("policy rule " + rule.String() + ": " + err.Error())
+			}
+			rule.re = re
+		}
+
+		switch rule.Action {
+		case "":
+			rule.allow = p.Mode == POLICY_MODE_ALLOWLIST
+		case POLICY_ACTION_ALLOW:
+			rule.allow = true
+		case POLICY_ACTION_DENY:
+			rule.allow = false
+		default:
+			return errors.New("policy rule " + rule.String() + " has invalid action: " + rule.Action)
+		}
+		rule.name = rule.String()
+		names = append(names, rule.name)
+	}
+	p.Version = fmt.Sprintf("%x", md5.Sum([]byte(p.Mode+"\n"+strings.Join(names, "\n"))))
+	return nil
+}
+
+// PolicyHost returns host the way rules are matched against it: lowercased,
+// without the trailing dot of a fully qualified name, and in its ASCII
+// (punycode) form.
+func PolicyHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return host
+}
+
+// Check returns a *PolicyError if u may not be fetched.
+func (p *Policy) Check(u *url.URL) error {
+	host := PolicyHost(u.Hostname())
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.Matches(host, u) {
+			continue
+		}
+		if rule.allow {
+			return nil
+		}
+		return &PolicyError{Rule: rule.name}
+	}
+
+	if p.Mode == POLICY_MODE_ALLOWLIST {
+		return &PolicyError{Rule: POLICY_MODE_ALLOWLIST}
+	}
+	return nil
+}
+
+// Matches reports whether the rule applies to u, whose host is passed in
+// separately as returned by PolicyHost.
+func (r *PolicyRule) Matches(host string, u *url.URL) bool {
+	if r.Host != "" && host != r.Host {
+		return false
+	}
+	if r.Domain != "" {
+		if strings.HasPrefix(r.Domain, "*.") {
+			if !strings.HasSuffix(host, r.Domain[1:]) {
+				return false
+			}
+		} else if host != r.Domain && !strings.HasSuffix(host, "."+r.Domain) {
+			return false
+		}
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(u.EscapedPath(), r.PathPrefix) {
+		return false
+	}
+	if r.re != nil {
+		target := host + u.EscapedPath()
+		if u.RawQuery != "" {
+			target = target + "?" + u.RawQuery
+		}
+		if !r.re.MatchString(target) {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the rule the way it is reported in blocked items, e.g.
+// "domain=example.com pathPrefix=/ads".
+func (r *PolicyRule) String() string {
+	var parts []string
+	if r.Host != "" {
+		parts = append(parts, "host="+r.Host)
+	}
+	if r.Domain != "" {
+		parts = append(parts, "domain="+r.Domain)
+	}
+	if r.PathPrefix != "" {
+		parts = append(parts, "pathPrefix="+r.PathPrefix)
+	}
+	if r.Regex != "" {
+		parts = append(parts, "regex="+r.Regex)
+	}
+	if r.Action != "" {
+		parts = append(parts, "action="+r.Action)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	HOST_LIMIT_QUEUE  = "queue"  // wait for the host up to MaxWaitMs
+	HOST_LIMIT_REJECT = "reject" // fail the item as soon as the host is saturated
+
+	HOST_LIMITERS_MAX = 10000 // prune idle hosts beyond this many
+)
+
+var (
+	RateLimited = errors.New("Rate limited (host saturated)")
+
+	hostLimitersLock sync.Mutex
+	hostLimiters     = make(map[string]*hostLimiter)
+)
+
+// HostLimitsConfig configures the per-host politeness limits shared by all
+// in-flight fetches: a token bucket of RequestsPerSec with Burst, and at most
+// MaxConnections concurrent fetches. A zero value disables that limit. In
+// queue mode fetches wait up to MaxWaitMs for the host, or as long as their
+// deadline allows without it.
+// Overrides apply to a domain and its subdomains, which then share one limit.
+type HostLimitsConfig struct {
+	RequestsPerSec float64             `yaml:"requestsPerSec"`
+	Burst          int                 `yaml:"burst"`
+	MaxConnections int                 `yaml:"maxConnections"`
+	OnLimit        string              `yaml:"onLimit"`
+	MaxWaitMs      int                 `yaml:"maxWaitMs"`
+	Overrides      []HostLimitOverride `yaml:"overrides"`
+
+	MaxWait time.Duration
+}
+
+// HostLimitOverride replaces the default limits for a domain.
+type HostLimitOverride struct {
+	Domain         string  `yaml:"domain"`
+	RequestsPerSec float64 `yaml:"requestsPerSec"`
+	Burst          int     `yaml:"burst"`
+	MaxConnections int     `yaml:"maxConnections"`
+}
+
+// hostLimiter holds the token bucket and connection slots for one host or
+// overridden domain.
+type hostLimiter struct {
+	limiter     *rate.Limiter
+	connections chan struct{}
+	lastUsed    time.Time
+}
+
+// Init validates the config and derives its durations.
+func (c *HostLimitsConfig) Init() error {
+	if c.OnLimit == "" {
+		c.OnLimit = HOST_LIMIT_QUEUE
+	}
+	if c.OnLimit != HOST_LIMIT_QUEUE && c.OnLimit != HOST_LIMIT_REJECT {
+		return errors.New("invalid hostLimits onLimit: " + c.OnLimit)
+	}
+	c.MaxWait = time.Duration(c.MaxWaitMs) * time.Millisecond
+	for i := range c.Overrides {
+		c.Overrides[i].Domain = strings.ToLower(c.Overrides[i].Domain)
+	}
+	return nil
+}
+
+// limitsFor returns the limiter key and limits that apply to host.
+func (c *HostLimitsConfig) limitsFor(host string) (string, float64, int, int) {
+	for _, override := range c.Overrides {
+		if host == override.Domain || strings.HasSuffix(host, "."+override.Domain) {
+			return override.Domain, override.RequestsPerSec, override.Burst, override.MaxConnections
+		}
+	}
+	return host, c.RequestsPerSec, c.Burst, c.MaxConnections
+}
+
+// getHostLimiter returns the shared limiter for host, creating it on first use.
+func getHostLimiter(host string) *hostLimiter {
+	key, requestsPerSec, burst, maxConnections := cfg.HostLimits.limitsFor(strings.ToLower(host))
+
+	hostLimitersLock.Lock()
+	defer hostLimitersLock.Unlock()
+	now := time.Now()
+	if len(hostLimiters) > HOST_LIMITERS_MAX {
+		for k, l := range hostLimiters {
+			if len(l.connections) == 0 && now.Sub(l.lastUsed) > time.Minute {
+				delete(hostLimiters, k)
+			}
+		}
+	}
+
+	l, ok := hostLimiters[key]
+	if !ok {
+		l = &hostLimiter{limiter: rate.NewLimiter(rate.Inf, 0)}
+		if requestsPerSec > 0 {
+			if burst < 1 {
+				burst = 1
+			}
+			l.limiter = rate.NewLimiter(rate.Limit(requestsPerSec), burst)
+		}
+		if maxConnections > 0 {
+			l.connections = make(chan struct{}, maxConnections)
+		}
+		hostLimiters[key] = l
+	}
+	l.lastUsed = now
+	return l
+}
+
+// AcquireHost waits for a request token and a connection slot for host, as
+// configured by cfg.HostLimits, giving up early if ctx is done. The returned
+// function releases the connection slot and is safe to call more than once.
+func AcquireHost(ctx context.Context, host string) (func(), error) {
+	l := getHostLimiter(host)
+	saturated := func() error {
+		if ctx.Err() != nil {
+			return FetchContextError(ctx)
+		}
+		return RateLimited
+	}
+
+	if cfg.HostLimits.OnLimit == HOST_LIMIT_REJECT {
+		// take the connection slot first so that a refused fetch does not
+		// spend a request token
+		if l.connections != nil {
+			select {
+			case l.connections <- struct{}{}:
+			default:
+				return nil, RateLimited
+			}
+		}
+		if !l.limiter.Allow() {
+			if l.connections != nil {
+				<-l.connections
+			}
+			return nil, RateLimited
+		}
+	} else {
+		// without MaxWait the wait is only bounded by ctx
+		waitCtx := ctx
+		if cfg.HostLimits.MaxWait > 0 {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(ctx, cfg.HostLimits.MaxWait)
+			defer cancel()
+		}
+		if l.connections != nil {
+			select {
+			case l.connections <- struct{}{}:
+			case <-waitCtx.Done():
+				return nil, saturated()
+			}
+		}
+		if err := l.limiter.Wait(waitCtx); err != nil {
+			if l.connections != nil {
+				<-l.connections
+			}
+			return nil, saturated()
+		}
+	}
+
+	if l.connections == nil {
+		return func() {}, nil
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.connections })
+	}, nil
+}
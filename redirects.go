@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	rj "github.com/bottlenose-inc/rapidjson" // faster json handling
+)
+
+const (
+	REDIRECT_HTTP         = "http"         // 3xx response with a Location header
+	REDIRECT_LINK_HEADER  = "link_header"  // Link header with rel="canonical"
+	REDIRECT_META_REFRESH = "meta_refresh" // <meta http-equiv="refresh">
+	REDIRECT_SCRIPT       = "script"       // javascript location redirect
+	REDIRECT_UNWRAP       = "unwrap"       // wrapper URL unwrapped by the unwrap rules, never fetched
+)
+
+// RedirectHop is one URL of a redirect chain. Mechanism is how it led to the
+// next hop and is empty for the last one; Status and Duration are zero for
+// hops that were not fetched.
+type RedirectHop struct {
+	URL       string
+	Status    int
+	Mechanism string
+	Duration  time.Duration
+}
+
+// RedirectChain records the hops taken while resolving a requested URL, and
+// the number of fetch attempts made for them including retries. It may be
+// copied while a fetch is recording into it.
+type RedirectChain struct {
+	lock     sync.Mutex
+	Hops     []RedirectHop
+	Attempts int
+}
+
+// Copy returns a copy of the chain so far.
+func (c *RedirectChain) Copy() *RedirectChain {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return &RedirectChain{Hops: append([]RedirectHop(nil), c.Hops...), Attempts: c.Attempts}
+}
+
+// Attempted counts a fetch attempt.
+func (c *RedirectChain) Attempted() {
+	c.lock.Lock()
+	c.Attempts++
+	c.lock.Unlock()
+}
+
+// Fetched records a fetched hop and how long it took since start.
+func (c *RedirectChain) Fetched(u string, status int, start time.Time) {
+	c.lock.Lock()
+	c.Hops = append(c.Hops, RedirectHop{URL: u, Status: status, Duration: time.Since(start)})
+	c.lock.Unlock()
+}
+
+// Redirected marks the last hop as redirecting with mechanism, and updates
+// its duration for redirects found only after reading the body.
+func (c *RedirectChain) Redirected(mechanism string, start time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.Hops) == 0 {
+		return
+	}
+	hop := &c.Hops[len(c.Hops)-1]
+	hop.Mechanism = mechanism
+	hop.Duration = time.Since(start)
+}
+
+// Unwrap returns u with any shortener or redirect wrappers removed, recording
+// each wrapper as a hop.
+func (c *RedirectChain) Unwrap(u string) string {
+	target, wrappers := UnwrapURL(u)
+	c.lock.Lock()
+	for _, wrapper := range wrappers {
+		c.Hops = append(c.Hops, RedirectHop{URL: wrapper, Mechanism: REDIRECT_UNWRAP})
+	}
+	c.lock.Unlock()
+	return target
+}
+
+// AddTo adds the chain to response as "redirectChain" if there was at least
+// one redirect, and the number of fetch attempts as "attempts" if there were
+// any. The hop objects are created in doc, which holds response.
+func (c *RedirectChain) AddTo(doc *rj.Doc, response *rj.Container) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.Hops) >= 2 {
+		var hops []*rj.Container
+		for _, hop := range c.Hops {
+			hopCt := doc.NewContainerObj()
+			hopCt.AddValue("url", hop.URL)
+			if hop.Status != 0 {
+				hopCt.AddValue("status", hop.Status)
+			}
+			if hop.Mechanism != "" {
+				hopCt.AddValue("mechanism", hop.Mechanism)
+			}
+			hopCt.AddValue("durationMs", int(hop.Duration.Seconds()*1000))
+			hops = append(hops, hopCt)
+		}
+		response.AddMemberArray("redirectChain", hops)
+	}
+	if c.Attempts > 0 {
+		response.AddValue("attempts", c.Attempts)
+	}
+}
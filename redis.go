@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	REDIS_STANDALONE = "standalone" // a single server at redisHost
+	REDIS_SENTINEL   = "sentinel"   // the master of MasterName, found through the sentinels
+	REDIS_CLUSTER    = "cluster"    // a cluster discovered from seed nodes
+)
+
+const (
+	REDIS_SCAN_COUNT = 500 // keys per SCAN and pipeline when deleting by prefix
+)
+
+var (
+	CacheUnavailable = errors.New("Cache unavailable")
+
+	redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+)
+
+// RedisConfig configures the redis connection. In sentinel mode Addrs are
+// the sentinels, which are asked for the current master of MasterName; in
+// cluster mode they are seed nodes. Username and Password authenticate as an
+// ACL user (or with requirepass, without Username); the password can also be
+// set in the REDIS_PASSWORD environment variable. While redis is unreachable
+// links are fetched uncached, and it is checked again every OutageCheckSec.
+type RedisConfig struct {
+	Mode             string         `yaml:"mode"`
+	Addrs            []string       `yaml:"addrs"`
+	MasterName       string         `yaml:"masterName"`
+	Username         string         `yaml:"username"`
+	Password         string         `yaml:"password"`
+	SentinelPassword string         `yaml:"sentinelPassword"`
+	TLS              RedisTLSConfig `yaml:"tls"`
+	OutageCheckSec   int            `yaml:"outageCheckSec"`
+
+	OutageCheck time.Duration
+	TLSConfig   *tls.Config
+}
+
+// RedisTLSConfig configures TLS to redis. CAFile verifies the server instead
+// of the system roots; CertFile and KeyFile are a client certificate.
+type RedisTLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// Init validates the config, loads the TLS files and derives its durations.
+// Standalone mode connects to redisHost unless Addrs is set.
+func (c *RedisConfig) Init(redisHost string) error {
+	if c.Mode == "" {
+		c.Mode = REDIS_STANDALONE
+	}
+	switch c.Mode {
+	case REDIS_STANDALONE:
+		if len(c.Addrs) == 0 {
+			c.Addrs = []string{redisHost}
+		}
+	case REDIS_SENTINEL:
+		if c.MasterName == "" || len(c.Addrs) == 0 {
+			return errors.New("redis sentinel mode needs masterName and addrs")
+		}
+	case REDIS_CLUSTER:
+		if len(c.Addrs) == 0 {
+			return errors.New("redis cluster mode needs addrs")
+		}
+	default:
+		return errors.New("invalid redis mode: " + c.Mode)
+	}
+	if password := os.Getenv("REDIS_PASSWORD"); password != "" {
+		c.Password = password
+	}
+
+	c.OutageCheck = time.Duration(c.OutageCheckSec) * time.Second
+	if c.OutageCheck <= 0 {
+		c.OutageCheck = 5 * time.Second
+	}
+
+	c.TLSConfig = nil
+	if c.TLS.Enabled {
+		tlsConfig, err := c.TLS.Config()
+		if err != nil {
+			return err
+		}
+		c.TLSConfig = tlsConfig
+	}
+	return nil
+}
+
+// Config builds the TLS config for redis connections.
+func (c *RedisTLSConfig) Config() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates in redis caFile " + c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// redisLogger writes the redis client's log to a file.
+type redisLogger struct {
+	*log.Logger
+}
+
+func (l redisLogger) Printf(ctx context.Context, format string, v ...interface{}) {
+	l.Logger.Printf(format, v...)
+}
+
+// NewRedisClient connects to the configured redis, logging to
+// log/redis-client.log.
+func NewRedisClient() redis.UniversalClient {
+	logFile, err := os.OpenFile("log/redis-client.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		logger.Error("Error creating Redis client logfile: " + err.Error())
+	} else {
+		redis.SetLogger(redisLogger{log.New(logFile, "", log.LstdFlags)})
+	}
+
+	options := &redis.UniversalOptions{
+		Addrs:            cfg.Redis.Addrs,
+		DB:               cfg.RedisDB,
+		MasterName:       cfg.Redis.MasterName,
+		Username:         cfg.Redis.Username,
+		Password:         cfg.Redis.Password,
+		SentinelPassword: cfg.Redis.SentinelPassword,
+		TLSConfig:        cfg.Redis.TLSConfig,
+	}
+	switch cfg.Redis.Mode {
+	case REDIS_SENTINEL:
+		return redis.NewFailoverClient(options.Failover())
+	case REDIS_CLUSTER:
+		return redis.NewClusterClient(options.Cluster())
+	default:
+		return redis.NewClient(options.Simple())
+	}
+}
+
+// RedisCache is a Cache stored in redis and shared by all instances. When
+// redis cannot be reached it is marked down, and until a background check
+// reaches it again every call fails straight away with CacheUnavailable.
+type RedisCache struct {
+	client      redis.UniversalClient
+	outageCheck time.Duration
+	down        int32
+}
+
+// NewRedisCache returns a Cache using client, checking it every outageCheck
+// while it is down.
+func NewRedisCache(client redis.UniversalClient, outageCheck time.Duration) *RedisCache {
+	c := &RedisCache{client: client, outageCheck: outageCheck}
+	c.Ready()
+	return c
+}
+
+// check passes on err, marking redis down if it is not a reply from redis.
+func (c *RedisCache) check(err error) error {
+	if err == nil || err == redis.Nil {
+		return err
+	}
+	if _, reply := err.(redis.Error); reply {
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&c.down, 0, 1) {
+		logger.Error("Redis unavailable, fetching links uncached until it is back: " + err.Error())
+		cacheAvailableGauge.Set(0)
+		go c.watchOutage()
+	}
+	return CacheUnavailable
+}
+
+// watchOutage pings redis until it answers again.
+func (c *RedisCache) watchOutage() {
+	for {
+		time.Sleep(c.outageCheck)
+		if err := c.client.Ping(context.Background()).Err(); err == nil {
+			atomic.StoreInt32(&c.down, 0)
+			cacheAvailableGauge.Set(1)
+			logger.Info("Redis available again")
+			return
+		}
+	}
+}
+
+// unavailable reports whether redis is marked down.
+func (c *RedisCache) unavailable() bool {
+	return atomic.LoadInt32(&c.down) == 1
+}
+
+func (c *RedisCache) Get(key string) (string, error) {
+	if c.unavailable() {
+		return "", CacheUnavailable
+	}
+	value, err := c.client.Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		return "", CacheMiss
+	}
+	return value, c.check(err)
+}
+
+func (c *RedisCache) Set(key string, value string, ttl time.Duration) error {
+	if c.unavailable() {
+		return CacheUnavailable
+	}
+	if ttl <= 0 {
+		// redis would keep the key forever, or keep its previous TTL
+		return c.check(c.client.Del(context.Background(), key).Err())
+	}
+	return c.check(c.client.Set(context.Background(), key, value, ttl).Err())
+}
+
+func (c *RedisCache) SetNX(key string, value string, ttl time.Duration) (bool, error) {
+	if c.unavailable() {
+		return false, CacheUnavailable
+	}
+	if ttl <= 0 {
+		return false, nil
+	}
+	locked, err := c.client.SetNX(context.Background(), key, value, ttl).Result()
+	return locked, c.check(err)
+}
+
+func (c *RedisCache) Delete(key string) error {
+	if c.unavailable() {
+		return CacheUnavailable
+	}
+	return c.check(c.client.Del(context.Background(), key).Err())
+}
+
+func (c *RedisCache) TTL(key string) (time.Duration, error) {
+	if c.unavailable() {
+		return 0, CacheUnavailable
+	}
+	ttl, err := c.client.TTL(context.Background(), key).Result()
+	if err == nil && ttl < 0 {
+		// missing keys; keys are always set with a TTL here
+		return 0, CacheMiss
+	}
+	return ttl, c.check(err)
+}
+
+// DeletePrefix scans for the keys starting with prefix, on every master of
+// a cluster, and deletes them. Keys are deleted one per command, in
+// pipelines, since the keys of a host are spread over the slots of a
+// cluster and a DEL of keys in different slots fails with CROSSSLOT.
+func (c *RedisCache) DeletePrefix(prefix string) (int, error) {
+	if c.unavailable() {
+		return 0, CacheUnavailable
+	}
+	ctx := context.Background()
+	match := redisGlobEscaper.Replace(prefix) + "*"
+	var deleted int64
+	deleteKeys := func(ctx context.Context, keys []string) error {
+		cmds, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.Del(ctx, key)
+			}
+			return nil
+		})
+		for _, cmd := range cmds {
+			atomic.AddInt64(&deleted, cmd.(*redis.IntCmd).Val())
+		}
+		return err
+	}
+	deleteFrom := func(ctx context.Context, client *redis.Client) error {
+		iter := client.Scan(ctx, 0, match, REDIS_SCAN_COUNT).Iterator()
+		var keys []string
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+			if len(keys) == REDIS_SCAN_COUNT {
+				if err := deleteKeys(ctx, keys); err != nil {
+					return err
+				}
+				keys = keys[:0]
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return deleteKeys(ctx, keys)
+		}
+		return nil
+	}
+
+	var err error
+	switch client := c.client.(type) {
+	case *redis.ClusterClient:
+		err = client.ForEachMaster(ctx, deleteFrom)
+	case *redis.Client:
+		err = deleteFrom(ctx, client)
+	default:
+		err = errors.New("unsupported redis client")
+	}
+	return int(atomic.LoadInt64(&deleted)), c.check(err)
+}
+
+// Ready pings redis unless it is already known to be down.
+func (c *RedisCache) Ready() error {
+	if c.unavailable() {
+		return CacheUnavailable
+	}
+	return c.check(c.client.Ping(context.Background()).Err())
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryConfig configures retrying fetches that failed with one of
+// RetryStatuses or RetryErrors. Retries wait BaseDelayMs doubling up to
+// MaxDelayMs, with jitter, or longer as asked by a Retry-After header of up
+// to MaxRetryAfterSec. No retry is started that would outlast the URL's
+// deadline.
+type RetryConfig struct {
+	MaxAttempts      int      `yaml:"maxAttempts"`
+	BaseDelayMs      int      `yaml:"baseDelayMs"`
+	MaxDelayMs       int      `yaml:"maxDelayMs"`
+	MaxRetryAfterSec int      `yaml:"maxRetryAfterSec"`
+	RetryStatuses    []int    `yaml:"retryStatuses"`
+	RetryErrors      []string `yaml:"retryErrors"`
+
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	MaxRetryAfter time.Duration
+}
+
+// Init validates the config and derives its durations.
+func (c *RetryConfig) Init() error {
+	if c.MaxAttempts < 1 {
+		c.MaxAttempts = 1
+	}
+	for _, class := range c.RetryErrors {
+		if class != ERROR_DNS && class != ERROR_TIMEOUT && class != ERROR_CONNECTION {
+			return errors.New("invalid retry error class: " + class)
+		}
+	}
+	c.BaseDelay = time.Duration(c.BaseDelayMs) * time.Millisecond
+	c.MaxDelay = time.Duration(c.MaxDelayMs) * time.Millisecond
+	if c.MaxDelay < c.BaseDelay {
+		c.MaxDelay = c.BaseDelay
+	}
+	c.MaxRetryAfter = time.Duration(c.MaxRetryAfterSec) * time.Second
+	return nil
+}
+
+// Backoff returns how long to wait before retrying a failed attempt, and the
+// reason for the retry: the status code or error class. The reason is empty
+// if the attempt should not be retried.
+func (c *RetryConfig) Backoff(attempt int, result *http.Response, err error) (time.Duration, string) {
+	if attempt >= c.MaxAttempts {
+		return 0, ""
+	}
+	reason := c.retryReason(result, err)
+	if reason == "" {
+		return 0, ""
+	}
+
+	delay := c.BaseDelay << uint(attempt-1)
+	if delay > c.MaxDelay || delay <= 0 {
+		delay = c.MaxDelay
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	if err == nil {
+		if retryAfter, ok := RetryAfter(result.Header.Get("Retry-After")); ok {
+			if retryAfter > c.MaxRetryAfter {
+				return 0, ""
+			}
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+	}
+	return delay, reason
+}
+
+func (c *RetryConfig) retryReason(result *http.Response, err error) string {
+	if err != nil {
+		class := TransientErrorClass(err)
+		for _, retryable := range c.RetryErrors {
+			if class != "" && class == retryable {
+				return class
+			}
+		}
+		return ""
+	}
+	for _, status := range c.RetryStatuses {
+		if result.StatusCode == status {
+			return strconv.Itoa(status)
+		}
+	}
+	return ""
+}
+
+// TransientErrorClass returns the error code of a failed request that is
+// worth retrying: ERROR_DNS for temporary resolver failures but not NXDOMAIN,
+// ERROR_TIMEOUT or ERROR_CONNECTION for refused or reset connections. It
+// returns "" for other errors.
+func TransientErrorClass(err error) string {
+	if errors.Is(err, AddressBlocked) {
+		return ""
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return ""
+		}
+		return ERROR_DNS
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ERROR_TIMEOUT
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ERROR_CONNECTION
+	}
+	return ""
+}
+
+// RetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func RetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if wait := time.Until(date); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// WaitRetry waits delay before a retry. It returns false without waiting if
+// the retry would start after ctx's deadline, or early if ctx is done.
+func WaitRetry(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
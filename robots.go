@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	ROBOTS_MAX_BYTES     = 500 * 1024 // parsing limit required by RFC 9309
+	ROBOTS_MAX_REDIRECTS = 5
+	ROBOTS_KEY_PREFIX    = "robots:"
+	ROBOTS_DISALLOW_ALL  = "User-agent: *\nDisallow: /\n"
+)
+
+var (
+	RobotsDisallowed = errors.New("Disallowed by robots.txt")
+	CrawlDelayed     = errors.New("Crawl-delay for host exceeds wait limit")
+	// RobotsUnavailable is returned by FetchRobots when redirects do not
+	// lead to a robots.txt that may be fetched
+	RobotsUnavailable = errors.New("robots.txt unavailable")
+
+	robotsFetches singleflight.Group // one robots.txt fetch per host at a time
+
+	crawlLock sync.Mutex
+	nextCrawl = make(map[string]time.Time) // earliest next fetch per host under Crawl-delay
+)
+
+// RobotsConfig configures robots.txt handling. Robots files are cached for
+// CacheTTLHours; a Crawl-delay is honored by waiting up to
+// MaxCrawlWaitSec for the host's next slot, after which the item errors.
+type RobotsConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	UserAgent       string `yaml:"userAgent"`
+	CacheTTLHours   int    `yaml:"cacheTTLhours"`
+	MaxCrawlWaitSec int    `yaml:"maxCrawlWaitSec"`
+
+	CacheTTL     time.Duration
+	MaxCrawlWait time.Duration
+}
+
+// RobotsRule is a single Allow or Disallow line.
+type RobotsRule struct {
+	Allow   bool
+	Pattern string
+}
+
+// Robots holds the rules of the robots.txt group that applies to us.
+type Robots struct {
+	Rules      []RobotsRule
+	CrawlDelay time.Duration
+}
+
+// CheckRobots returns RobotsDisallowed if robots.txt forbids fetching u, and
+// otherwise waits for the host's Crawl-delay if it has one. Errors fetching
+// robots.txt, such as a rate limited or unreachable host, fail the fetch.
+func CheckRobots(ctx context.Context, u *url.URL) error {
+	if u.Path == "/robots.txt" {
+		return nil
+	}
+	robots, err := GetRobots(ctx, u)
+	if err != nil {
+		return err
+	}
+	if !robots.Allowed(u) {
+		return RobotsDisallowed
+	}
+	if robots.CrawlDelay > 0 {
+		return WaitCrawlDelay(ctx, u.Host, robots.CrawlDelay)
+	}
+	return nil
+}
+
+// GetRobots returns the parsed robots.txt for the host of u, from the cache when
+// cached. Concurrent callers share one fetch, which runs within
+// cfg.FetchBudget whether or not they wait for it; a caller whose ctx is done
+// stops waiting. A robots.txt that cannot be fetched is not cached; one that
+// answers with a server error is cached as disallowing everything.
+func GetRobots(ctx context.Context, u *url.URL) (*Robots, error) {
+	robotsUrl := u.Scheme + "://" + u.Host + "/robots.txt"
+	key := ROBOTS_KEY_PREFIX + u.Scheme + "://" + u.Host
+
+	robotsTxt, err := cache.Get(key)
+	if err == nil {
+		return ParseRobots(robotsTxt, cfg.Robots.UserAgent), nil
+	}
+
+	fetched := robotsFetches.DoChan(key, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.Background(), cfg.FetchBudget)
+		defer cancel()
+		robotsTxt, status, err := FetchRobots(fetchCtx, robotsUrl)
+		if err == RobotsUnavailable {
+			status = http.StatusNotFound
+		} else if err != nil {
+			logger.Warning("robots.txt fetch fail: " + err.Error())
+			return "", err
+		}
+
+		ttl := cfg.Robots.CacheTTL
+		switch {
+		case status >= 200 && status < 300:
+		case status >= 400 && status < 500:
+			// no robots.txt, everything is allowed
+			robotsTxt = ""
+		default:
+			// an unreachable robots.txt disallows everything, as in RFC 9309,
+			// until it is retried after the error TTL
+			robotsTxt = ROBOTS_DISALLOW_ALL
+			ttl = cfg.RedisErrorTTL
+		}
+		if err := cache.Set(key, robotsTxt, ttl); err != nil {
+			logCacheError("Error saving robots.txt in cache", err)
+		}
+		return robotsTxt, nil
+	})
+	select {
+	case result := <-fetched:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return ParseRobots(result.Val.(string), cfg.Robots.UserAgent), nil
+	case <-ctx.Done():
+		return nil, FetchContextError(ctx)
+	}
+}
+
+// FetchRobots fetches a robots.txt file within the host's rate limit and
+// circuit breaker, following a limited number of redirects allowed by the
+// policy, and returns its body and status code. It returns RobotsUnavailable
+// when the redirects lead nowhere it may fetch, which RFC 9309 treats as if
+// there were no robots.txt.
+func FetchRobots(ctx context.Context, robotsUrl string) (string, int, error) {
+	for i := 0; i <= ROBOTS_MAX_REDIRECTS; i++ {
+		getReq, err := http.NewRequestWithContext(ctx, "GET", robotsUrl, nil)
+		if err != nil {
+			return "", 0, err
+		}
+		result, releaseHost, err := FetchAttempt(ctx, getReq)
+		if err != nil {
+			releaseHost()
+			if urlError, ok := err.(*url.Error); ok && urlError.Err == RedirectAttempted {
+				location, err := result.Location()
+				result.Body.Close()
+				if err != nil {
+					return "", 0, RobotsUnavailable
+				}
+				if cfg.Policy.Check(location) != nil {
+					return "", 0, RobotsUnavailable
+				}
+				robotsUrl = location.String()
+				continue
+			}
+			return "", 0, err
+		}
+
+		body, err := ioutil.ReadAll(NewCappedReader(result.Body, ROBOTS_MAX_BYTES))
+		result.Body.Close()
+		releaseHost()
+		return string(body), result.StatusCode, err
+	}
+	return "", 0, RobotsUnavailable
+}
+
+// ParseRobots parses a robots.txt file and keeps the rules of the group
+// matching userAgent, falling back to the "*" group. Groups naming the same
+// agent are merged.
+func ParseRobots(robotsTxt string, userAgent string) *Robots {
+	userAgent = strings.ToLower(userAgent)
+	matched, wildcard := &Robots{}, &Robots{}
+	hasMatched := false
+
+	var current []*Robots
+	inAgents := false
+	for _, line := range strings.Split(robotsTxt, "\n") {
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i == -1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			// consecutive user-agent lines share one group
+			if !inAgents {
+				current = nil
+				inAgents = true
+			}
+			agent := strings.ToLower(value)
+			if agent == "*" {
+				current = append(current, wildcard)
+			} else if userAgent != "" && agent == userAgent {
+				current = append(current, matched)
+				hasMatched = true
+			}
+		case "allow", "disallow":
+			inAgents = false
+			if value == "" {
+				continue
+			}
+			for _, group := range current {
+				group.Rules = append(group.Rules, RobotsRule{Allow: key == "allow", Pattern: value})
+			}
+		case "crawl-delay":
+			inAgents = false
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || seconds < 0 {
+				continue
+			}
+			for _, group := range current {
+				group.CrawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		default:
+			inAgents = false
+		}
+	}
+
+	if hasMatched {
+		return matched
+	}
+	return wildcard
+}
+
+// Allowed reports whether u may be fetched. The longest matching pattern
+// wins and Allow wins ties, as in RFC 9309.
+func (r *Robots) Allowed(u *url.URL) bool {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path = path + "?" + u.RawQuery
+	}
+
+	allowed, longest := true, -1
+	for _, rule := range r.Rules {
+		if !MatchRobotsPattern(rule.Pattern, path) {
+			continue
+		}
+		if len(rule.Pattern) > longest || (len(rule.Pattern) == longest && rule.Allow) {
+			allowed, longest = rule.Allow, len(rule.Pattern)
+		}
+	}
+	return allowed
+}
+
+// MatchRobotsPattern matches path against a robots.txt path pattern, where
+// "*" matches any sequence of characters and a trailing "$" anchors the end.
+func MatchRobotsPattern(pattern string, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		j := strings.Index(rest, part)
+		if j == -1 {
+			return false
+		}
+		rest = rest[j+len(part):]
+	}
+	return !anchored || rest == ""
+}
+
+// WaitCrawlDelay blocks until host may be fetched again under its
+// Crawl-delay, or returns CrawlDelayed if that is more than
+// cfg.Robots.MaxCrawlWait away. The wait ends early if ctx is done.
+func WaitCrawlDelay(ctx context.Context, host string, delay time.Duration) error {
+	crawlLock.Lock()
+	now := time.Now()
+	next := nextCrawl[host]
+	if next.Before(now) {
+		next = now
+	}
+	wait := next.Sub(now)
+	if wait > cfg.Robots.MaxCrawlWait {
+		crawlLock.Unlock()
+		return CrawlDelayed
+	}
+	nextCrawl[host] = next.Add(delay)
+
+	// drop hosts whose delay has passed so the map does not grow unbounded
+	if len(nextCrawl) > 10000 {
+		for h, t := range nextCrawl {
+			if t.Before(now) {
+				delete(nextCrawl, h)
+			}
+		}
+	}
+	crawlLock.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return FetchContextError(ctx)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	rj "github.com/bottlenose-inc/rapidjson" // faster json handling
+)
+
+const (
+	REFRESH_LOCK_PREFIX  = "refresh:"
+	DEFAULT_REFRESH_LOCK = 30 * time.Second // without refreshLockSec
+)
+
+// StaleConfig configures stale-while-revalidate. Results without caching
+// headers are fresh for SoftTTLHours; past their TTL they are served as they
+// are, flagged stale, while one background refresh per RefreshLockSec
+// updates them. They are dropped after RedisTTLDays, the hard TTL.
+type StaleConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	SoftTTLHours   int  `yaml:"softTTLhours"`
+	RefreshLockSec int  `yaml:"refreshLockSec"`
+
+	SoftTTL     time.Duration
+	RefreshLock time.Duration
+}
+
+// Init derives the durations; the soft TTL cannot exceed cfg.RedisTTL, and
+// the refresh lock defaults to DEFAULT_REFRESH_LOCK, as it could never be
+// taken without a TTL.
+func (c *StaleConfig) Init() {
+	c.SoftTTL = time.Duration(c.SoftTTLHours) * time.Hour
+	if c.SoftTTL <= 0 || c.SoftTTL > cfg.RedisTTL {
+		c.SoftTTL = cfg.RedisTTL
+	}
+	c.RefreshLock = time.Duration(c.RefreshLockSec) * time.Second
+	if c.RefreshLock <= 0 {
+		c.RefreshLock = DEFAULT_REFRESH_LOCK
+	}
+}
+
+// RefreshStale refreshes the stale result cachedStr cached under hash, unless
+// another request or instance already is. Failed refreshes leave the stale
+// result in place and release the refresh lock, so that the next request
+// for it tries again.
+func RefreshStale(reqStr string, u *url.URL, rootUrl string, hash string, cachedStr string, chain *RedirectChain) {
+	lockKey := REFRESH_LOCK_PREFIX + hash
+	token := lockToken()
+	locked, err := cache.SetNX(lockKey, token, cfg.Stale.RefreshLock)
+	if err != nil || !locked {
+		return
+	}
+	refreshed := false
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			PanicError(recovered)
+		}
+		if !refreshed {
+			staleRefreshCounterVector.WithLabelValues("failed").Inc()
+			// only release the lock if it has not expired and been taken over
+			if current, err := cache.Get(lockKey); err == nil && current == token {
+				cache.Delete(lockKey)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.FetchBudget)
+	defer cancel()
+	cachedJson, err := rj.NewParsedStringJson(cachedStr)
+	if err == nil {
+		defer cachedJson.Free()
+		if RevalidateCached(ctx, hash, cachedJson.GetContainer()) {
+			staleRefreshCounterVector.WithLabelValues("not_modified").Inc()
+			refreshed = true
+			return
+		}
+	}
+
+	responseJson := rj.NewDoc()
+	defer responseJson.Free()
+	response := responseJson.GetContainerNewObj()
+	if err := FetchItem(ctx, reqStr, u, rootUrl, chain, responseJson, response); err != nil {
+		logger.Warning("Stale refresh fail: " + err.Error())
+		return
+	}
+	staleRefreshCounterVector.WithLabelValues("refreshed").Inc()
+	refreshed = true
+	if err := SetResult(hash, response.String(), cfg.RedisTTL); err != nil {
+		logCacheError("Error saving response in cache", err)
+	}
+}
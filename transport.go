@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+)
+
+const (
+	DISCARD_MAX_BYTES = 4 * 1024 // unread body left over to keep a connection
+)
+
+// connTrace counts whether each fetch got a pooled connection or a new one.
+var connTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		connReuseCounterVector.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+	},
+}
+
+// TransportConfig configures connection pooling for fetches. Idle
+// connections are kept for IdleConnTimeoutSec, at most MaxIdleConns in total
+// and MaxIdleConnsPerHost per host; HTTP2 is negotiated with hosts that
+// support it.
+type TransportConfig struct {
+	KeepAlive           bool `yaml:"keepAlive"`
+	MaxIdleConns        int  `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int  `yaml:"maxIdleConnsPerHost"`
+	IdleConnTimeoutSec  int  `yaml:"idleConnTimeoutSec"`
+	HTTP2               bool `yaml:"http2"`
+
+	IdleConnTimeout time.Duration
+}
+
+// NewTransport returns the transport used for fetches. Every connection is
+// checked by CheckDialAddress, including those made for redirects.
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.HTTPGetTimeout,
+			KeepAlive: 30 * time.Second,
+			Control:   CheckDialAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: cfg.HTTPGetTimeout,
+		DisableCompression:  true,
+		DisableKeepAlives:   !cfg.Transport.KeepAlive,
+		MaxIdleConns:        cfg.Transport.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.Transport.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.Transport.IdleConnTimeout,
+		ForceAttemptHTTP2:   cfg.Transport.HTTP2,
+	}
+}
+
+// DiscardBody reads what is left of a small response body and closes it, so
+// that its connection goes back to the idle pool. A larger remainder is
+// abandoned, which closes the connection instead.
+func DiscardBody(body io.ReadCloser) {
+	io.CopyN(ioutil.Discard, body, DISCARD_MAX_BYTES)
+	body.Close()
+}
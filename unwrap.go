@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	irukaConfig "github.com/bottlenose-inc/go-common-tools/config" // go-common-tools config loader
+)
+
+const (
+	UNWRAP_MAX_DEPTH = 5 // wrappers nested inside each other, e.g. safelinks around google.com/url
+)
+
+var (
+	unwrapLock  sync.RWMutex
+	unwrapRules = &UnwrapRules{}
+)
+
+// UnwrapRules are the rules used to take the real target out of shortener
+// and redirect wrapper URLs before they are fetched. They are loaded from
+// cfg.UnwrapRulesFile and reloaded when the file changes.
+type UnwrapRules struct {
+	Rules []UnwrapRule `yaml:"rules"`
+}
+
+// UnwrapRule extracts a target URL either with a regex, whose first capture
+// group is the target, or from the first of Params holding an absolute URL on
+// URLs of Domain (or its subdomains) and, if set, Path. Examples are checked
+// when the rules are loaded.
+type UnwrapRule struct {
+	Name     string          `yaml:"name"`
+	Regex    string          `yaml:"regex"`
+	Domain   string          `yaml:"domain"`
+	Path     string          `yaml:"path"`
+	Params   []string        `yaml:"params"`
+	Examples []UnwrapExample `yaml:"examples"`
+
+	re *regexp.Regexp
+}
+
+// UnwrapExample is a wrapped URL and the target a rule must extract from it.
+type UnwrapExample struct {
+	URL    string `yaml:"url"`
+	Target string `yaml:"target"`
+}
+
+// LoadUnwrapRules reads and compiles the rules in path.
+func LoadUnwrapRules(path string) (*UnwrapRules, error) {
+	rules := &UnwrapRules{}
+	if err := irukaConfig.GetConfig(rules, path); err != nil {
+		return nil, err
+	}
+	if err := rules.Compile(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Compile validates the rules, prepares them for matching and checks that
+// each one extracts the expected target from its examples.
+func (r *UnwrapRules) Compile() error {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		rule.Domain = strings.ToLower(rule.Domain)
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return errors.New("unwrap rule " + rule.Name + ": " + err.Error())
+			}
+			rule.re = re
+		} else if rule.Domain == "" || len(rule.Params) == 0 {
+			return errors.New("unwrap rule " + rule.Name + " needs a regex, or a domain and params")
+		}
+
+		for _, example := range rule.Examples {
+			if target := rule.Unwrap(example.URL); target != example.Target {
+				return errors.New("unwrap rule " + rule.Name + " example " + example.URL + " gave " + target + ", expected " + example.Target)
+			}
+		}
+	}
+	return nil
+}
+
+// WatchUnwrapRules reloads the rules file whenever its modification time
+// changes. Rules that fail to load are logged and the current ones kept.
+func WatchUnwrapRules(path string, interval time.Duration) {
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			logger.Error("Error checking unwrap rules file: " + err.Error())
+			continue
+		}
+		if info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+
+		rules, err := LoadUnwrapRules(path)
+		if err != nil {
+			logger.Error("Error reloading unwrap rules, keeping current rules: " + err.Error())
+			continue
+		}
+		SetUnwrapRules(rules)
+		logger.Info("Reloaded unwrap rules from " + path)
+	}
+}
+
+// SetUnwrapRules replaces the rules used by CheckRedirectURL.
+func SetUnwrapRules(rules *UnwrapRules) {
+	unwrapLock.Lock()
+	unwrapRules = rules
+	unwrapLock.Unlock()
+}
+
+// Unwrap returns the target of the first rule matching u, or "".
+func (r *UnwrapRules) Unwrap(u string) string {
+	for i := range r.Rules {
+		if target := r.Rules[i].Unwrap(u); target != "" {
+			return target
+		}
+	}
+	return ""
+}
+
+// Unwrap returns the target the rule extracts from u, or "" if it does not
+// match.
+func (r *UnwrapRule) Unwrap(u string) string {
+	if r.re != nil {
+		if match := r.re.FindStringSubmatch(u); len(match) > 1 {
+			return match[1]
+		}
+		return ""
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if host != r.Domain && !strings.HasSuffix(host, "."+r.Domain) {
+		return ""
+	}
+	if r.Path != "" && parsed.Path != r.Path {
+		return ""
+	}
+	query := parsed.Query()
+	for _, param := range r.Params {
+		value := query.Get(param)
+		target, err := url.Parse(value)
+		if err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != "" {
+			return value
+		}
+	}
+	return ""
+}